@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"time"
@@ -11,6 +12,10 @@ import (
 
 var sCookie = securecookie.New(securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32))
 
+type ctxKey int
+
+const userCtxKey ctxKey = iota
+
 // ---------------- middleware ----------------
 func authMiddleware(next http.Handler, cfg *Config) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -23,8 +28,9 @@ func authMiddleware(next http.Handler, cfg *Config) http.Handler {
 		if cookie, err := r.Cookie("noc2go"); err == nil {
 			if err := sCookie.Decode("noc2go", cookie.Value, &value); err == nil {
 				if u := lookupUser(cfg, value["user"]); u != nil {
-					// attach current user to context (optional)
-					next.ServeHTTP(w, r)
+					// attach current user to context
+					ctx := context.WithValue(r.Context(), userCtxKey, u)
+					next.ServeHTTP(w, r.WithContext(ctx))
 					return
 				}
 			}
@@ -43,6 +49,23 @@ func lookupUser(cfg *Config, name string) *UserEntry {
 	return nil
 }
 
+// currentUser returns the logged-in user attached by authMiddleware
+func currentUser(r *http.Request) *UserEntry {
+	u, _ := r.Context().Value(userCtxKey).(*UserEntry)
+	return u
+}
+
+// requireAdmin rejects requests from users without the Admin role
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if u := currentUser(r); u == nil || u.Role != Admin {
+			http.Error(w, "admin role required", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
 // ---------------- handlers ----------------
 func handleLogin(cfg *Config) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
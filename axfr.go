@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const axfrTimeout = 10 * time.Second // dial and per-message read timeout
+
+// tsigAlgorithms maps the config names to the miekg/dns algorithm names
+var tsigAlgorithms = map[string]string{
+	"hmac-sha1":   dns.HmacSHA1,
+	"hmac-sha224": dns.HmacSHA224,
+	"hmac-sha256": dns.HmacSHA256,
+	"hmac-sha384": dns.HmacSHA384,
+	"hmac-sha512": dns.HmacSHA512,
+}
+
+// axfrRecord is one transferred record, RDATA in presentation format
+type axfrRecord struct {
+	Name  string `json:"name"`
+	TTL   uint32 `json:"ttl"`
+	Class string `json:"class"`
+	Type  string `json:"type"`
+	Data  string `json:"data"`
+}
+
+// axfrPageHandler serves the zone transfer page; the template gets the
+// names of the configured TSIG keys
+func axfrPageHandler(cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var keys []string
+		for _, k := range cfg.DNS.TSIGKeys {
+			keys = append(keys, k.Name)
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		templates.ExecuteTemplate(w, "axfr.html", keys)
+	}
+}
+
+// apiAXFRHandler streams GET /api/dns/axfr?zone=...&server=...&type=AXFR|IXFR&serial=...&key=...
+// via SSE: one "records" event per transfer message, then a "summary"
+func apiAXFRHandler(cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		zone := dns.CanonicalName(dns.Fqdn(strings.TrimSpace(q.Get("zone"))))
+		if zone == "." || q.Get("server") == "" {
+			http.Error(w, "zone and server are required", http.StatusBadRequest)
+			return
+		}
+		up, err := parseUpstream(q.Get("server"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		t := &dns.Transfer{DialTimeout: axfrTimeout, ReadTimeout: axfrTimeout}
+		switch up.Proto {
+		case "udp":
+		case "tls":
+			// XFR over TLS (RFC 9103)
+			up.TLS.NextProtos = []string{"dot"}
+			t.TLS = up.TLS
+		default:
+			http.Error(w, "zone transfers need a plain or tls:// server", http.StatusBadRequest)
+			return
+		}
+
+		msg := new(dns.Msg)
+		typ := strings.ToUpper(q.Get("type"))
+		switch typ {
+		case "", "AXFR":
+			typ = "AXFR"
+			msg.SetAxfr(zone)
+		case "IXFR":
+			serial, err := strconv.ParseUint(q.Get("serial"), 10, 32)
+			if err != nil {
+				http.Error(w, "IXFR needs the serial the secondary has", http.StatusBadRequest)
+				return
+			}
+			msg.SetIxfr(zone, uint32(serial), ".", ".")
+		default:
+			http.Error(w, "type must be AXFR or IXFR", http.StatusBadRequest)
+			return
+		}
+
+		keyName := q.Get("key")
+		if keyName != "" {
+			key, err := tsigKey(cfg, keyName)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			t.TsigSecret = map[string]string{dns.CanonicalName(key.Name): key.Secret}
+			msg.SetTsig(dns.CanonicalName(key.Name), tsigAlgorithms[strings.ToLower(key.Algorithm)], 300, time.Now().Unix())
+		}
+
+		flusher, ok := startSSE(w)
+		if !ok {
+			return
+		}
+		summary := map[string]interface{}{"zone": zone, "server": up.Addr, "type": typ, "tsig": keyName}
+		start := time.Now()
+		count, messages := 0, 0
+		env, err := t.In(msg, up.Addr)
+		if err == nil {
+			ctx := r.Context()
+		loop:
+			for {
+				select {
+				case <-ctx.Done():
+					// unblock and drain the transfer goroutine
+					t.Close()
+					go func() {
+						for range env {
+						}
+					}()
+					return
+				case e, ok := <-env:
+					if !ok {
+						break loop
+					}
+					if e.Error != nil {
+						err = e.Error
+					}
+					if len(e.RR) > 0 {
+						messages++
+						recs := make([]axfrRecord, 0, len(e.RR))
+						for _, rr := range e.RR {
+							h := rr.Header()
+							if soa, ok := rr.(*dns.SOA); ok && count == 0 {
+								summary["serial"] = soa.Serial
+							}
+							recs = append(recs, axfrRecord{
+								Name:  h.Name,
+								TTL:   h.Ttl,
+								Class: dns.Class(h.Class).String(),
+								Type:  dns.Type(h.Rrtype).String(),
+								Data:  rdataString(rr),
+							})
+							count++
+						}
+						data, _ := json.Marshal(map[string]interface{}{"records": recs, "count": count})
+						fmt.Fprintf(w, "event: records\ndata: %s\n\n", data)
+						flusher.Flush()
+					}
+				}
+			}
+		}
+		if err != nil {
+			summary["error"] = err.Error()
+		}
+		summary["records"] = count
+		summary["messages"] = messages
+		summary["time"] = float64(time.Since(start)) / float64(time.Millisecond)
+		data, _ := json.Marshal(summary)
+		fmt.Fprintf(w, "event: summary\ndata: %s\n\n", data)
+		flusher.Flush()
+	}
+}
+
+// tsigKey looks up a configured key and checks its algorithm
+func tsigKey(cfg *Config, name string) (TSIGKey, error) {
+	for _, k := range cfg.DNS.TSIGKeys {
+		if strings.EqualFold(dns.Fqdn(k.Name), dns.Fqdn(name)) {
+			if k.Algorithm == "" {
+				k.Algorithm = "hmac-sha256"
+			}
+			if _, ok := tsigAlgorithms[strings.ToLower(k.Algorithm)]; !ok {
+				return k, fmt.Errorf("TSIG key %s: unsupported algorithm %q", k.Name, k.Algorithm)
+			}
+			return k, nil
+		}
+	}
+	return TSIGKey{}, fmt.Errorf("unknown TSIG key %q", name)
+}
@@ -23,6 +23,13 @@ type UserEntry struct {
 	Expires  string `yaml:"expires,omitempty"` // RFC3339, optional
 }
 
+// TSIGKey is a shared secret for signed zone transfers
+type TSIGKey struct {
+	Name      string `yaml:"name"`
+	Algorithm string `yaml:"algorithm,omitempty"` // e.g. hmac-sha256 (default)
+	Secret    string `yaml:"secret"`              // base64
+}
+
 type Config struct {
 	Server struct {
 		Port int    `yaml:"port"`
@@ -32,14 +39,23 @@ type Config struct {
 		Users []UserEntry `yaml:"users"`
 	} `yaml:"auth"`
 	Tools struct {
-		AllowPrivileged bool `yaml:"allow_privileged"`
+		AllowPrivileged     bool `yaml:"allow_privileged"`
+		PortScanConcurrency int  `yaml:"portscan_concurrency,omitempty"` // workers per scan, 0 = defaultPortScanConcurrency
+		PortScanRate        int  `yaml:"portscan_rate,omitempty"`        // connects per second, 0 = defaultPortScanRate, at most maxPortScanRate
+		PortScanMaxRunning  int  `yaml:"portscan_max_running,omitempty"` // concurrent scans per user, 0 = defaultPortScanMaxRunning
 	} `yaml:"tools"`
 	DNS struct {
-		CustomServers []string `yaml:"custom_servers"`
+		CustomServers []string  `yaml:"custom_servers"`
+		EDNSBufSize   int       `yaml:"edns_bufsize,omitempty"`  // 0 = defaultEDNSBufSize
+		TrustAnchors  []string  `yaml:"trust_anchors,omitempty"` // root DS records, default rootTrustAnchors
+		TSIGKeys      []TSIGKey `yaml:"tsig_keys,omitempty"`
 	} `yaml:"dns,omitempty"`
 	// New Ping targets list
 	Ping struct {
-		Targets []string `yaml:"targets,omitempty"`
+		Targets       []string `yaml:"targets,omitempty"`
+		MaxCount      int      `yaml:"max_count,omitempty"`      // 0 = defaultPingMaxCount, at most 65535
+		MinInterval   float64  `yaml:"min_interval,omitempty"`   // seconds, 0 = defaultPingMinInterval
+		MaxConcurrent int      `yaml:"max_concurrent,omitempty"` // per user, 0 = defaultPingMaxConcurrent
 	} `yaml:"ping,omitempty"`
 }
 
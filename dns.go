@@ -1,12 +1,16 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"net/netip"
 	"strings"
-	"sync"
 	"time"
 
 	"strconv"
@@ -15,21 +19,10 @@ import (
 )
 
 const (
-	dnsTimeout = 5 * time.Second
-	cacheTTL   = 60 * time.Second
+	dnsTimeout         = 5 * time.Second
+	defaultEDNSBufSize = 1232 // DNS flag day 2020
 )
 
-var (
-	dnsCache   = make(map[string]cacheEntry)
-	cacheMutex sync.Mutex
-)
-
-type cacheEntry struct {
-	timestamp time.Time
-	records   interface{}
-	err       error
-}
-
 // page data for template
 type dnsPageData struct {
 	CustomServers []string
@@ -46,170 +39,321 @@ func dnsPageHandler(cfg *Config) http.HandlerFunc {
 	}
 }
 
-// apiDNSHandler handles GET /api/dns?name=...&type=...&server=...
-func apiDNSHandler(w http.ResponseWriter, r *http.Request) {
-	name := r.URL.Query().Get("name")
-	typ := strings.ToUpper(r.URL.Query().Get("type"))
-	serverParam := r.URL.Query().Get("server")
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	if name == "" || typ == "" {
-		fmt.Fprint(w, `{"error":"name and type are required"}`)
-		return
-	}
+// dnsOptions tune how a query is sent
+type dnsOptions struct {
+	Transport string // "" (udp with tcp fallback), udp or tcp; plain servers only
+	BufSize   int    // EDNS0 UDP payload size, 0 = defaultEDNSBufSize
+	NoEDNS    bool   // send the query without OPT record
+	NoCache   bool   // skip the cache lookup; the fresh result is still stored
 
-	records, serverUsed, err := lookupDNS(name, typ, serverParam)
-	if err != nil {
-		fmt.Fprintf(w, `{"error":%q}`, err.Error())
-		return
-	}
-	resp := map[string]interface{}{
-		"server":  serverUsed,
-		"records": records,
-	}
-	data, _ := json.Marshal(resp)
-	fmt.Fprint(w, string(data))
+	Subnet netip.Prefix // EDNS Client Subnet to send, zero for none
+	NSID   bool         // ask for the server's NSID
+	Cookie string       // DNS cookie to send (hex client cookie, optionally followed by a server cookie); bypasses the cache
+	DO     bool         // DNSSEC OK, always set for DNSSEC types and ANY
+	CD     bool         // checking disabled
 }
 
-// lookupDNS does the actual query (with caching and timeout, override via serverParam)
-func lookupDNS(name, typ, override string) (interface{}, string, error) {
-	lookupName := name
-	if typ == "PTR" {
-		if ip := net.ParseIP(name); ip != nil {
-			lookupName = reverseIP(ip)
+// apiDNSHandler handles GET /api/dns?name=...&type=...&server=...&transport=...&bufsize=...&nocache=...&format=...
+// plus the EDNS options of parseDNSOptions
+// (trace=true streams an iterative resolution, see traceDNS; dnssec=true
+// returns the chain of trust, see validateDNSSEC); POST resolves a list of
+// names, see bulkDNS
+func apiDNSHandler(cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			bulkDNS(w, r, cfg)
+			return
+		}
+		name := r.URL.Query().Get("name")
+		typ := strings.ToUpper(r.URL.Query().Get("type"))
+		serverParam := r.URL.Query().Get("server")
+		dig := r.URL.Query().Get("format") == "dig"
+		if dig {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		} else {
-			lower := strings.ToLower(name)
-			if !(strings.HasSuffix(lower, ".in-addr.arpa") || strings.HasSuffix(lower, ".ip6.arpa")) {
-				return nil, "", fmt.Errorf("invalid input for PTR lookup: must be IP or reverse-ARPA domain")
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		}
+		if name == "" || typ == "" {
+			if dig {
+				fmt.Fprintln(w, ";; name and type are required")
+			} else {
+				fmt.Fprint(w, `{"error":"name and type are required"}`)
 			}
+			return
+		}
+
+		if r.URL.Query().Get("trace") == "true" {
+			traceDNS(w, r, name, typ, serverParam)
+			return
+		}
+		if r.URL.Query().Get("dnssec") == "true" {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			report, err := validateDNSSEC(r.Context(), cfg, name, typ, serverParam)
+			if err != nil {
+				fmt.Fprintf(w, `{"error":%q}`, err.Error())
+				return
+			}
+			data, _ := json.Marshal(report)
+			fmt.Fprint(w, string(data))
+			return
+		}
+
+		opts, err := parseDNSOptions(r, cfg)
+		if err != nil {
+			if dig {
+				fmt.Fprintf(w, ";; %s\n", err)
+			} else {
+				fmt.Fprintf(w, `{"error":%q}`, err.Error())
+			}
+			return
+		}
+
+		res, err := queryDNS(r.Context(), name, typ, serverParam, opts)
+		if dig {
+			if res.Msg == nil {
+				fmt.Fprintf(w, ";; %s\n", err)
+				return
+			}
+			writeDig(w, res, name, typ)
+			return
+		}
+		// NXDOMAIN still has a message worth showing (authority SOA etc.)
+		if res.Msg == nil {
+			fmt.Fprintf(w, `{"error":%q}`, err.Error())
+			return
 		}
+		resp := res.response()
+		if err != nil {
+			resp.Error = err.Error()
+		}
+		data, _ := json.Marshal(resp)
+		fmt.Fprint(w, string(data))
 	}
+}
 
-	// choose which DNS server to use
-	var serverUsed string
-	if override != "" && override != "system" {
-		serverUsed = override
-	} else {
-		sys := collectDNSServers()
-		if len(sys) > 0 && sys[0] != "unavailable" {
-			serverUsed = net.JoinHostPort(sys[0], "53")
-		} else {
-			serverUsed = "8.8.8.8:53"
+// parseDNSOptions reads transport, bufsize, nocache and the EDNS and header
+// options ecs, nsid, cookie, do and cd from the query or a POSTed form; the
+// buffer size defaults to Config.DNS.EDNSBufSize and 0 disables EDNS0
+func parseDNSOptions(r *http.Request, cfg *Config) (dnsOptions, error) {
+	opts := dnsOptions{
+		Transport: strings.ToLower(r.FormValue("transport")),
+		BufSize:   cfg.DNS.EDNSBufSize,
+		NoCache:   r.FormValue("nocache") == "true",
+		NSID:      r.FormValue("nsid") == "true",
+		DO:        r.FormValue("do") == "true",
+		CD:        r.FormValue("cd") == "true",
+	}
+	switch opts.Transport {
+	case "", "udp", "tcp":
+	default:
+		return opts, fmt.Errorf("transport must be udp or tcp")
+	}
+	if v := r.FormValue("bufsize"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 65535 || (n > 0 && n < 512) {
+			return opts, fmt.Errorf("bufsize must be 0 (no EDNS) or between 512 and 65535")
 		}
+		opts.BufSize, opts.NoEDNS = n, n == 0
 	}
-	// ensure host:port
-	if !strings.Contains(serverUsed, ":") {
-		serverUsed = net.JoinHostPort(serverUsed, "53")
+	if v := strings.TrimSpace(r.FormValue("ecs")); v != "" {
+		subnet, err := parseClientSubnet(v)
+		if err != nil {
+			return opts, err
+		}
+		opts.Subnet = subnet
+	}
+	switch v := strings.ToLower(strings.TrimSpace(r.FormValue("cookie"))); v {
+	case "", "false":
+	case "true":
+		b := make([]byte, 8)
+		rand.Read(b)
+		opts.Cookie = hex.EncodeToString(b)
+	default:
+		// RFC 7873: 8 bytes client cookie, optionally 8 to 32 bytes server cookie
+		b, err := hex.DecodeString(v)
+		if err != nil || (len(b) != 8 && (len(b) < 16 || len(b) > 40)) {
+			return opts, errors.New("cookie must be true or a hex client cookie of 8 bytes, optionally followed by an 8 to 32 byte server cookie")
+		}
+		opts.Cookie = v
 	}
+	if opts.NoEDNS && (opts.Subnet.IsValid() || opts.NSID || opts.Cookie != "" || opts.DO) {
+		return opts, errors.New("ecs, nsid, cookie and do need EDNS0 (bufsize must not be 0)")
+	}
+	return opts, nil
+}
 
-	key := strings.ToLower(lookupName + "|" + typ + "|" + serverUsed)
-	cacheMutex.Lock()
-	if e, ok := dnsCache[key]; ok && time.Since(e.timestamp) < cacheTTL {
-		cacheMutex.Unlock()
-		return e.records, serverUsed, e.err
+// parseClientSubnet reads an ECS prefix; a bare address stands for its /24
+// (IPv4) or /56 (IPv6) as recommended by RFC 7871, 0.0.0.0/0 opts out
+func parseClientSubnet(v string) (netip.Prefix, error) {
+	if !strings.Contains(v, "/") {
+		addr, err := netip.ParseAddr(v)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("ecs must be an address or prefix")
+		}
+		bits := 24
+		if addr.Is6() && !addr.Is4In6() {
+			bits = 56
+		}
+		v = fmt.Sprintf("%s/%d", addr.Unmap(), bits)
+	}
+	prefix, err := netip.ParsePrefix(v)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("ecs must be an address or prefix")
 	}
-	cacheMutex.Unlock()
+	return prefix.Masked(), nil
+}
 
-	client := new(dns.Client)
-	client.Timeout = dnsTimeout
-	msg := new(dns.Msg)
-	qtype, ok := map[string]uint16{
-		"A":    dns.TypeA,
-		"AAAA": dns.TypeAAAA,
-		"MX":   dns.TypeMX,
-		"NS":   dns.TypeNS,
-		"PTR":  dns.TypePTR,
-		"TXT":  dns.TypeTXT,
-		"SRV":  dns.TypeSRV,
-	}[typ]
-	if !ok {
-		return nil, serverUsed, fmt.Errorf("unsupported record type %q", typ)
+// lookupDNS returns the structured answer records for name/typ (see queryDNS)
+func lookupDNS(ctx context.Context, name, typ, override string) (interface{}, string, error) {
+	res, err := queryDNS(ctx, name, typ, override, dnsOptions{})
+	if err != nil {
+		return nil, res.Server, err
 	}
-	msg.SetQuestion(dns.Fqdn(lookupName), qtype)
+	return answerRecords(res.Msg, res.Qtype), res.Server, nil
+}
 
-	resp, _, err := client.Exchange(msg, serverUsed)
+// queryDNS does the actual query (with caching and timeout, override via
+// serverParam). Truncated UDP answers are retried over TCP unless a
+// transport was forced. The result is never nil; Msg is set whenever an
+// answer arrived, including NXDOMAIN. Answers are cached for their TTL,
+// failed exchanges are not (see dnsResultCache). The exchange is abandoned
+// when ctx is cancelled.
+func queryDNS(ctx context.Context, name, typ, override string, opts dnsOptions) (*dnsResult, error) {
+	res := &dnsResult{}
+	lookupName, err := queryName(name, typ)
 	if err != nil {
-		cacheMutex.Lock()
-		dnsCache[key] = cacheEntry{time.Now(), nil, err}
-		cacheMutex.Unlock()
-		return nil, serverUsed, err
+		return res, err
 	}
-	if resp.Rcode == dns.RcodeNameError {
-		err = fmt.Errorf("NXDOMAIN")
-		cacheMutex.Lock()
-		dnsCache[key] = cacheEntry{time.Now(), nil, err}
-		cacheMutex.Unlock()
-		return nil, serverUsed, err
-	}
-
-	var out interface{}
-	switch qtype {
-	case dns.TypeA:
-		var arr []map[string]string
-		for _, ans := range resp.Answer {
-			if rr, ok := ans.(*dns.A); ok {
-				arr = append(arr, map[string]string{"address": rr.A.String()})
-			}
-		}
-		out = arr
-	case dns.TypeAAAA:
-		var arr []map[string]string
-		for _, ans := range resp.Answer {
-			if rr, ok := ans.(*dns.AAAA); ok {
-				arr = append(arr, map[string]string{"address": rr.AAAA.String()})
-			}
+
+	serverUsed := chooseServer(override)
+	up, err := parseUpstream(serverUsed)
+	if err != nil {
+		return res, err
+	}
+	// plain servers are reported as host:port
+	if up.Proto == "udp" {
+		serverUsed = up.Addr
+		if opts.Transport != "" {
+			up.Proto = opts.Transport
 		}
-		out = arr
-	case dns.TypeMX:
-		var arr []map[string]interface{}
-		for _, ans := range resp.Answer {
-			if rr, ok := ans.(*dns.MX); ok {
-				arr = append(arr, map[string]interface{}{"host": rr.Mx, "priority": rr.Preference})
-			}
+	} else if opts.Transport != "" {
+		return res, fmt.Errorf("transport %s only applies to plain DNS servers", opts.Transport)
+	}
+	res.Server, res.Transport = serverUsed, up.Proto
+	if opts.BufSize <= 0 {
+		opts.BufSize = defaultEDNSBufSize
+	}
+
+	key := strings.ToLower(fmt.Sprintf("%s|%s|%s|%s|%d|%t|%s|%t|%t|%t", lookupName, typ, serverUsed, opts.Transport,
+		opts.BufSize, opts.NoEDNS, opts.Subnet, opts.NSID, opts.DO, opts.CD))
+	// a cookie is only meaningful in a fresh exchange
+	cacheable := opts.Cookie == ""
+	if !opts.NoCache && cacheable {
+		if hit, ok := dnsCache.get(key); ok {
+			return hit.result, hit.err
 		}
-		out = arr
-	case dns.TypeNS:
-		var arr []map[string]string
-		for _, ans := range resp.Answer {
-			if rr, ok := ans.(*dns.NS); ok {
-				arr = append(arr, map[string]string{"host": rr.Ns})
+	}
+
+	msg := new(dns.Msg)
+	qtype, err := parseQueryType(typ)
+	if err != nil {
+		return res, err
+	}
+	res.Qtype = qtype
+	msg.SetQuestion(dns.Fqdn(lookupName), qtype)
+	msg.CheckingDisabled = opts.CD
+	if !opts.NoEDNS {
+		msg.SetEdns0(uint16(opts.BufSize), opts.DO || dnssecQueryTypes[qtype] || qtype == dns.TypeANY)
+		opt := msg.IsEdns0()
+		if opts.Subnet.IsValid() {
+			ecs := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: uint8(opts.Subnet.Bits()), Address: opts.Subnet.Addr().AsSlice()}
+			if opts.Subnet.Addr().Is6() {
+				ecs.Family = 2
 			}
+			opt.Option = append(opt.Option, ecs)
 		}
-		out = arr
-	case dns.TypePTR:
-		var arr []map[string]string
-		for _, ans := range resp.Answer {
-			if rr, ok := ans.(*dns.PTR); ok {
-				arr = append(arr, map[string]string{"host": rr.Ptr})
-			}
+		if opts.NSID {
+			opt.Option = append(opt.Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID})
 		}
-		out = arr
-	case dns.TypeTXT:
-		var arr []map[string]string
-		for _, ans := range resp.Answer {
-			if rr, ok := ans.(*dns.TXT); ok {
-				arr = append(arr, map[string]string{"text": strings.Join(rr.Txt, "")})
-			}
+		if opts.Cookie != "" {
+			opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: opts.Cookie})
+			res.Cookie = opts.Cookie[:16]
 		}
-		out = arr
-	case dns.TypeSRV:
-		var arr []map[string]interface{}
-		for _, ans := range resp.Answer {
-			if rr, ok := ans.(*dns.SRV); ok {
-				arr = append(arr, map[string]interface{}{
-					"target":   rr.Target,
-					"port":     rr.Port,
-					"priority": rr.Priority,
-					"weight":   rr.Weight,
-				})
-			}
+	}
+
+	res.When = time.Now()
+	resp, rtt, err := up.exchange(ctx, msg)
+	if err != nil {
+		return res, err
+	}
+	if resp.Truncated && up.Proto == "udp" && opts.Transport == "" {
+		res.Truncated, res.Transport, up.Proto = true, "tcp", "tcp"
+		resp, rtt, err = up.exchange(ctx, msg)
+		if err != nil {
+			return res, err
 		}
-		out = arr
 	}
+	res.Msg, res.RTT = resp, rtt
+	if resp.Rcode == dns.RcodeNameError {
+		err = fmt.Errorf("NXDOMAIN")
+	}
+
+	if !cacheable {
+		return res, err
+	}
+	dnsCache.put(&dnsCacheEntry{
+		key:       key,
+		name:      cacheName(lookupName),
+		typ:       typ,
+		server:    serverUsed,
+		transport: res.Transport,
+		result:    res,
+		err:       err,
+	})
+	return res, err
+}
+
+// chooseServer returns the override or, for "" and "system", the first
+// system resolver (8.8.8.8 if there is none)
+func chooseServer(override string) string {
+	if override != "" && override != "system" {
+		return override
+	}
+	sys := collectDNSServers()
+	if len(sys) > 0 && sys[0] != "unavailable" {
+		return net.JoinHostPort(sys[0], "53")
+	}
+	return "8.8.8.8:53"
+}
 
-	cacheMutex.Lock()
-	dnsCache[key] = cacheEntry{time.Now(), out, nil}
-	cacheMutex.Unlock()
-	return out, serverUsed, nil
+// queryName returns the owner name to query; PTR lookups accept an IP
+func queryName(name, typ string) (string, error) {
+	if typ != "PTR" {
+		return name, nil
+	}
+	if ip := net.ParseIP(name); ip != nil {
+		return reverseIP(ip), nil
+	}
+	lower := strings.ToLower(name)
+	if !(strings.HasSuffix(lower, ".in-addr.arpa") || strings.HasSuffix(lower, ".ip6.arpa")) {
+		return "", fmt.Errorf("invalid input for PTR lookup: must be IP or reverse-ARPA domain")
+	}
+	return name, nil
+}
+
+// parseQueryType accepts type mnemonics and the generic RFC 3597 notation
+// (e.g. TYPE65)
+func parseQueryType(typ string) (uint16, error) {
+	qtype, ok := dns.StringToType[typ]
+	if !ok {
+		if n, err := strconv.ParseUint(strings.TrimPrefix(typ, "TYPE"), 10, 16); err == nil && strings.HasPrefix(typ, "TYPE") {
+			qtype, ok = uint16(n), true
+		}
+	}
+	if !ok || unsupportedQueryTypes[qtype] {
+		return 0, fmt.Errorf("unsupported record type %q", typ)
+	}
+	return qtype, nil
 }
 
 // reverseIP builds the in-addr or ip6.arpa name for an IP
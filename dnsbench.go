@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	dnsBenchTimeout       = 2 * time.Second // per query; slower answers count as timeouts
+	dnsBenchMaxNames      = 20
+	dnsBenchMaxRounds     = 10
+	dnsBenchDefaultRounds = 3
+	dnsBenchSlowRate      = 5 // % timeouts above which a resolver ranks last
+	dnsBenchDefaultNames  = "google.com,youtube.com,facebook.com,wikipedia.org,amazon.com,microsoft.com,cloudflare.com,github.com"
+)
+
+// dnsBenchECSPrefix is sent as EDNS Client Subnet (a documentation network)
+var dnsBenchECSPrefix = net.IPv4(192, 0, 2, 0)
+
+// dnsBenchResolver is the result of one resolver, the payload of a
+// "resolver" event. Latencies are in ms over the answered queries.
+type dnsBenchResolver struct {
+	Rank           int     `json:"rank,omitempty"`
+	Server         string  `json:"server"`
+	Source         string  `json:"source"` // system or custom
+	Queries        int     `json:"queries"`
+	Answered       int     `json:"answered"`
+	Timeouts       int     `json:"timeouts"`
+	Errors         int     `json:"errors"`       // other failures, SERVFAIL and REFUSED included
+	TimeoutRate    float64 `json:"timeout_rate"` // %
+	Median         float64 `json:"median"`
+	P95            float64 `json:"p95"`
+	CachedMedian   float64 `json:"cached_median"`
+	UncachedMedian float64 `json:"uncached_median"`
+	DNSSEC         string  `json:"dnssec"` // validating, passthrough, none or unknown
+	ECS            string  `json:"ecs"`    // supported, none or unknown
+	ECSScope       int     `json:"ecs_scope,omitempty"`
+	Error          string  `json:"error,omitempty"`
+}
+
+// dnsBenchPageHandler renders GET /dnsbench
+func dnsBenchPageHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	templates.ExecuteTemplate(w, "dnsbench.html", strings.ReplaceAll(dnsBenchDefaultNames, ",", ", "))
+}
+
+// apiDNSBenchHandler streams GET /api/dns/bench?names=...&type=...&rounds=...
+// via SSE. Every system and custom resolver is benchmarked in parallel, the
+// queries to one resolver run one after the other: per name and round one
+// query that should be cached (after a warm-up query) and one for a random
+// label below the name that cannot be. A "resolver" event is sent as each
+// finishes and the "summary" holds the ranked table.
+func apiDNSBenchHandler(cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		spec := q.Get("names")
+		if strings.TrimSpace(spec) == "" {
+			spec = dnsBenchDefaultNames
+		}
+		names := strings.FieldsFunc(spec, func(c rune) bool { return c == ',' || c == ' ' || c == '\n' })
+		if len(names) > dnsBenchMaxNames {
+			http.Error(w, fmt.Sprintf("at most %d names", dnsBenchMaxNames), http.StatusBadRequest)
+			return
+		}
+		for i, n := range names {
+			if _, ok := dns.IsDomainName(n); !ok {
+				http.Error(w, fmt.Sprintf("invalid name %q", n), http.StatusBadRequest)
+				return
+			}
+			names[i] = dns.Fqdn(n)
+		}
+		typ := strings.ToUpper(q.Get("type"))
+		if typ == "" {
+			typ = "A"
+		}
+		qtype, err := parseQueryType(typ)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rounds := dnsBenchDefaultRounds
+		if v := q.Get("rounds"); v != "" {
+			rounds, err = strconv.Atoi(v)
+			if err != nil || rounds < 1 || rounds > dnsBenchMaxRounds {
+				http.Error(w, fmt.Sprintf("rounds must be between 1 and %d", dnsBenchMaxRounds), http.StatusBadRequest)
+				return
+			}
+		}
+		var resolvers []dnsBenchResolver
+		for _, c := range compareResolvers(cfg) {
+			resolvers = append(resolvers, dnsBenchResolver{Server: c.Server, Source: c.Source})
+		}
+		if len(resolvers) == 0 {
+			http.Error(w, "no resolvers configured", http.StatusBadRequest)
+			return
+		}
+
+		release, ok := acquireProbeSlot(w, r, cfg)
+		if !ok {
+			return
+		}
+		defer release()
+
+		flusher, ok := startSSE(w)
+		if !ok {
+			return
+		}
+		servers := make([]string, len(resolvers))
+		for i, res := range resolvers {
+			servers[i] = res.Server
+		}
+		data, _ := json.Marshal(map[string]interface{}{
+			"resolvers": servers,
+			"names":     len(names),
+			"type":      typ,
+			"rounds":    rounds,
+			"queries":   2 * len(names) * rounds, // per resolver
+		})
+		fmt.Fprintf(w, "event: start\ndata: %s\n\n", data)
+		flusher.Flush()
+
+		ctx := r.Context()
+		start := time.Now()
+		done := make(chan int)
+		var wg sync.WaitGroup
+		for i := range resolvers {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				benchResolver(ctx, &resolvers[i], names, qtype, rounds)
+				select {
+				case done <- i:
+				case <-ctx.Done():
+				}
+			}(i)
+		}
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		for i := range done {
+			data, _ := json.Marshal(resolvers[i])
+			fmt.Fprintf(w, "event: resolver\ndata: %s\n\n", data)
+			flusher.Flush()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		rankResolvers(resolvers)
+		data, _ = json.Marshal(map[string]interface{}{"resolvers": resolvers, "elapsed": msSince(start)})
+		fmt.Fprintf(w, "event: summary\ndata: %s\n\n", data)
+		flusher.Flush()
+	}
+}
+
+// benchResolver runs the latency queries and the DNSSEC and ECS probes
+// against one resolver, bypassing the cache of noc2go
+func benchResolver(ctx context.Context, b *dnsBenchResolver, names []string, qtype uint16, rounds int) {
+	up, err := parseUpstream(b.Server)
+	if err != nil {
+		b.Error, b.DNSSEC, b.ECS = err.Error(), "unknown", "unknown"
+		return
+	}
+	var all, cached, uncached []float64
+	measure := func(name string, into *[]float64) {
+		b.Queries++
+		m, rtt, err := benchExchange(ctx, up, name, qtype, false, nil)
+		switch {
+		case err != nil && benchTimeout(err):
+			b.Timeouts++
+		case err != nil || m.Rcode == dns.RcodeServerFailure || m.Rcode == dns.RcodeRefused:
+			b.Errors++
+		default:
+			b.Answered++
+			ms := float64(rtt) / float64(time.Millisecond)
+			all = append(all, ms)
+			*into = append(*into, ms)
+		}
+	}
+	for _, name := range names {
+		benchExchange(ctx, up, name, qtype, false, nil) // warm-up
+	}
+	for round := 0; round < rounds && ctx.Err() == nil; round++ {
+		for _, name := range names {
+			measure(name, &cached)
+			measure(randomLabel()+"."+name, &uncached)
+		}
+	}
+	b.TimeoutRate = 100 * float64(b.Timeouts) / float64(max(b.Queries, 1))
+	for _, s := range [][]float64{all, cached, uncached} {
+		sort.Float64s(s)
+	}
+	b.Median, b.P95 = percentile(all, 50), percentile(all, 95)
+	b.CachedMedian, b.UncachedMedian = percentile(cached, 50), percentile(uncached, 50)
+	if b.Answered == 0 {
+		b.Error = "no answers"
+	}
+
+	// the root zone is signed, a validating resolver sets AD on its SOA
+	b.DNSSEC = "unknown"
+	if m, _, err := benchExchange(ctx, up, ".", dns.TypeSOA, true, nil); err == nil && m.Rcode == dns.RcodeSuccess {
+		b.DNSSEC = "none"
+		for _, rr := range m.Answer {
+			if rr.Header().Rrtype == dns.TypeRRSIG {
+				b.DNSSEC = "passthrough"
+			}
+		}
+		if m.AuthenticatedData {
+			b.DNSSEC = "validating"
+		}
+	}
+
+	// a resolver that supports ECS echoes the option with its scope
+	b.ECS = "unknown"
+	ecs := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: dnsBenchECSPrefix}
+	if m, _, err := benchExchange(ctx, up, names[0], dns.TypeA, false, ecs); err == nil && m.Rcode != dns.RcodeFormatError {
+		b.ECS = "none"
+		if opt := m.IsEdns0(); opt != nil {
+			for _, o := range opt.Option {
+				if s, ok := o.(*dns.EDNS0_SUBNET); ok {
+					b.ECS, b.ECSScope = "supported", int(s.SourceScope)
+				}
+			}
+		}
+	}
+}
+
+// benchExchange sends one recursive query with EDNS, optionally with the
+// DO bit and an extra EDNS option
+func benchExchange(ctx context.Context, up *dnsUpstream, name string, qtype uint16, do bool, opt dns.EDNS0) (*dns.Msg, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, dnsBenchTimeout)
+	defer cancel()
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, qtype)
+	msg.SetEdns0(defaultEDNSBufSize, do)
+	if opt != nil {
+		msg.IsEdns0().Option = append(msg.IsEdns0().Option, opt)
+	}
+	m, rtt, err := up.exchange(ctx, msg)
+	if err == nil && m.Truncated && up.Proto == "udp" {
+		tcp := *up
+		tcp.Proto = "tcp"
+		m, rtt, err = tcp.exchange(ctx, msg)
+	}
+	return m, rtt, err
+}
+
+// benchTimeout reports whether err means the resolver did not answer in time
+func benchTimeout(err error) bool {
+	var ne net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout())
+}
+
+// randomLabel returns a label that no resolver has cached
+func randomLabel() string {
+	b := make([]byte, 6)
+	for i := range b {
+		b[i] = byte(rand.IntN(256))
+	}
+	return "n2g-" + hex.EncodeToString(b)
+}
+
+// rankResolvers sorts by median latency, resolvers with more than
+// dnsBenchSlowRate % timeouts or without answers last, and numbers them
+func rankResolvers(resolvers []dnsBenchResolver) {
+	demoted := func(b dnsBenchResolver) bool {
+		return b.Answered == 0 || b.TimeoutRate > dnsBenchSlowRate
+	}
+	sort.SliceStable(resolvers, func(i, j int) bool {
+		a, b := resolvers[i], resolvers[j]
+		if demoted(a) != demoted(b) {
+			return !demoted(a)
+		}
+		if a.Median != b.Median {
+			return a.Median < b.Median
+		}
+		return a.P95 < b.P95
+	})
+	for i := range resolvers {
+		resolvers[i].Rank = i + 1
+	}
+}
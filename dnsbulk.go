@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	dnsBulkMaxNames    = 5000
+	dnsBulkMaxUpload   = 4 << 20
+	dnsBulkConcurrency = 20
+)
+
+// dnsBulkQuery is one line of the input; Type defaults to the request's type
+type dnsBulkQuery struct {
+	Name string
+	Type string
+}
+
+// dnsBulkResult is the payload of a "result" event and one row of the
+// CSV/JSON download
+type dnsBulkResult struct {
+	Index   int      `json:"index"` // position in the input
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`
+	Rcode   string   `json:"rcode,omitempty"`
+	Answers []string `json:"answers"` // RDATA of the answers of Type
+	TTL     uint32   `json:"ttl"`     // smallest TTL of the answers
+	RTT     float64  `json:"rtt"`     // ms
+	Cached  bool     `json:"cached"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// bulkDNS handles POST /api/dns with a list of names (form field "names" or
+// an uploaded "file", one name per line or CSV with the name in the first
+// column and an optional type in the second). The names are resolved in
+// parallel and streamed as SSE "result" events between "start" and
+// "summary"; format=csv or format=json returns the complete table as a
+// download instead.
+func bulkDNS(w http.ResponseWriter, r *http.Request, cfg *Config) {
+	r.Body = http.MaxBytesReader(w, r.Body, dnsBulkMaxUpload)
+	if err := r.ParseMultipartForm(dnsBulkMaxUpload); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		http.Error(w, "reading the upload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	input := r.FormValue("names")
+	if f, _, err := r.FormFile("file"); err == nil {
+		data, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			http.Error(w, "reading the upload: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		input += "\n" + string(data)
+	}
+	typ := strings.ToUpper(strings.TrimSpace(r.FormValue("type")))
+	if typ == "" {
+		typ = "A"
+	}
+	queries, err := parseBulkNames(input, typ)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts, err := parseDNSOptions(r, cfg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	server := r.FormValue("server")
+	format := r.FormValue("format")
+	switch format {
+	case "", "csv", "json":
+	default:
+		http.Error(w, "format must be csv or json", http.StatusBadRequest)
+		return
+	}
+
+	release, ok := acquireProbeSlot(w, r, cfg)
+	if !ok {
+		return
+	}
+	defer release()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	start := time.Now()
+	results := resolveBulk(ctx, queries, server, opts)
+
+	if format != "" {
+		var all []dnsBulkResult
+		for res := range results {
+			all = append(all, res)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		sort.Slice(all, func(i, j int) bool { return all[i].Index < all[j].Index })
+		writeBulkFile(w, format, all)
+		return
+	}
+
+	flusher, ok := startSSE(w)
+	if !ok {
+		return
+	}
+	data, _ := json.Marshal(map[string]interface{}{"total": len(queries), "type": typ, "server": chooseServer(server)})
+	fmt.Fprintf(w, "event: start\ndata: %s\n\n", data)
+	flusher.Flush()
+
+	counts := map[string]int{}
+	for res := range results {
+		switch {
+		case res.Rcode == "NOERROR" && len(res.Answers) > 0:
+			counts["answered"]++
+		case res.Rcode == "NOERROR":
+			counts["nodata"]++
+		case res.Rcode == "NXDOMAIN":
+			counts["nxdomain"]++
+		default:
+			counts["failed"]++
+		}
+		data, _ := json.Marshal(res)
+		fmt.Fprintf(w, "event: result\ndata: %s\n\n", data)
+		flusher.Flush()
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	data, _ = json.Marshal(map[string]interface{}{
+		"total":    len(queries),
+		"answered": counts["answered"],
+		"nodata":   counts["nodata"],
+		"nxdomain": counts["nxdomain"],
+		"failed":   counts["failed"],
+		"elapsed":  msSince(start),
+	})
+	fmt.Fprintf(w, "event: summary\ndata: %s\n\n", data)
+	flusher.Flush()
+}
+
+// parseBulkNames reads the list as CSV; header rows and blank names are
+// skipped, "#" starts a comment
+func parseBulkNames(input, typ string) ([]dnsBulkQuery, error) {
+	if _, err := parseQueryType(typ); err != nil {
+		return nil, err
+	}
+	rd := csv.NewReader(strings.NewReader(input))
+	rd.FieldsPerRecord = -1
+	rd.TrimLeadingSpace = true
+	rd.Comment = '#'
+	var out []dnsBulkQuery
+	for line := 1; ; line++ {
+		row, err := rd.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := strings.TrimSpace(row[0])
+		if name == "" {
+			continue
+		}
+		switch strings.ToLower(name) {
+		case "name", "host", "hostname", "domain", "fqdn", "ip", "address":
+			continue // header row
+		}
+		q := dnsBulkQuery{Name: name, Type: typ}
+		if len(row) > 1 && strings.TrimSpace(row[1]) != "" {
+			q.Type = strings.ToUpper(strings.TrimSpace(row[1]))
+			if _, err := parseQueryType(q.Type); err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+		}
+		out = append(out, q)
+		if len(out) > dnsBulkMaxNames {
+			return nil, fmt.Errorf("at most %d names per request", dnsBulkMaxNames)
+		}
+	}
+	if len(out) == 0 {
+		return nil, errors.New("no names given")
+	}
+	return out, nil
+}
+
+// resolveBulk runs the queries on a bounded worker pool; the channel is
+// closed when all are done or ctx is cancelled
+func resolveBulk(ctx context.Context, queries []dnsBulkQuery, server string, opts dnsOptions) <-chan dnsBulkResult {
+	jobs := make(chan int)
+	results := make(chan dnsBulkResult, dnsBulkConcurrency)
+	go func() {
+		defer close(jobs)
+		for i := range queries {
+			select {
+			case <-ctx.Done():
+				return
+			case jobs <- i:
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < dnsBulkConcurrency && i < len(queries); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				res := resolveBulkOne(ctx, i, queries[i], server, opts)
+				select {
+				case results <- res:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	return results
+}
+
+// resolveBulkOne looks up one name through queryDNS (and so the cache)
+func resolveBulkOne(ctx context.Context, index int, q dnsBulkQuery, server string, opts dnsOptions) dnsBulkResult {
+	res := dnsBulkResult{Index: index, Name: q.Name, Type: q.Type, Answers: []string{}}
+	r, err := queryDNS(ctx, q.Name, q.Type, server, opts)
+	if r.Msg == nil {
+		res.Error = err.Error()
+		return res
+	}
+	res.Rcode = dns.RcodeToString[r.Msg.Rcode]
+	res.RTT = float64(r.RTT) / float64(time.Millisecond)
+	res.Cached = r.Cached
+	for _, rr := range r.Msg.Answer {
+		h := rr.Header()
+		if h.Rrtype != r.Qtype && r.Qtype != dns.TypeANY {
+			continue
+		}
+		if len(res.Answers) == 0 || h.Ttl < res.TTL {
+			res.TTL = h.Ttl
+		}
+		data := rdataString(rr)
+		if r.Qtype == dns.TypeANY {
+			data = dns.Type(h.Rrtype).String() + " " + data
+		}
+		res.Answers = append(res.Answers, data)
+	}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	return res
+}
+
+// writeBulkFile sends the results as a CSV or JSON attachment
+func writeBulkFile(w http.ResponseWriter, format string, results []dnsBulkResult) {
+	name := "dns-bulk-" + time.Now().Format("20060102-150405") + "." + format
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if results == nil {
+			results = []dnsBulkResult{}
+		}
+		data, _ := json.MarshalIndent(results, "", "  ")
+		w.Write(data)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"name", "type", "rcode", "answers", "ttl", "rtt_ms", "cached", "error"})
+	for _, res := range results {
+		cw.Write([]string{
+			res.Name,
+			res.Type,
+			res.Rcode,
+			strings.Join(res.Answers, " | "),
+			strconv.FormatUint(uint64(res.TTL), 10),
+			strconv.FormatFloat(res.RTT, 'f', 1, 64),
+			strconv.FormatBool(res.Cached),
+			res.Error,
+		})
+	}
+	cw.Flush()
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	dnsCacheSize   = 1024      // entries kept, least recently used evicted first
+	dnsCacheMaxTTL = time.Hour // upper bound for answer and negative TTLs
+)
+
+// dnsCache holds the answers of queryDNS
+var dnsCache = newDNSResultCache(dnsCacheSize)
+
+// dnsCacheEntry is one cached answer; err is kept for NXDOMAIN
+type dnsCacheEntry struct {
+	key       string
+	name      string // owner name queried, lower case without trailing dot
+	typ       string
+	server    string
+	transport string
+	stored    time.Time
+	expires   time.Time
+	result    *dnsResult
+	err       error
+}
+
+// dnsResultCache is a bounded LRU of query results that expire with the
+// TTL of the answer (RFC 2308 for negative answers)
+type dnsResultCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List // front = most recently used
+	hits    uint64
+	misses  uint64
+}
+
+func newDNSResultCache(size int) *dnsResultCache {
+	return &dnsResultCache{size: size, entries: make(map[string]*list.Element), lru: list.New()}
+}
+
+// get returns a copy of a live entry whose result is marked as cached,
+// with the TTLs reduced by the time it spent in the cache
+func (c *dnsResultCache) get(key string) (*dnsCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	e := el.Value.(*dnsCacheEntry)
+	now := time.Now()
+	if !now.Before(e.expires) {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.lru.MoveToFront(el)
+
+	res := copyResult(e.result)
+	res.Cached = true
+	age := uint32(now.Sub(e.stored) / time.Second)
+	for _, section := range [][]dns.RR{res.Msg.Answer, res.Msg.Ns, res.Msg.Extra} {
+		for _, rr := range section {
+			if h := rr.Header(); h.Rrtype != dns.TypeOPT {
+				if h.Ttl > age {
+					h.Ttl -= age
+				} else {
+					h.Ttl = 0
+				}
+			}
+		}
+	}
+	hit := *e
+	hit.result = res
+	return &hit, true
+}
+
+// put stores a copy of a result for as long as its TTL allows; answers that
+// must not be cached (TTL 0, SERVFAIL, negative answers without SOA) are
+// dropped
+func (c *dnsResultCache) put(e *dnsCacheEntry) {
+	ttl := cacheLifetime(e.result.Msg)
+	if ttl <= 0 {
+		return
+	}
+	e.result = copyResult(e.result)
+	e.stored = time.Now()
+	e.expires = e.stored.Add(ttl)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[e.key]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[e.key] = c.lru.PushFront(e)
+	for c.lru.Len() > c.size {
+		old := c.lru.Back()
+		c.lru.Remove(old)
+		delete(c.entries, old.Value.(*dnsCacheEntry).key)
+	}
+}
+
+// copyResult copies a result and its message, so callers and the cache
+// never share one that the other may modify
+func copyResult(r *dnsResult) *dnsResult {
+	res := *r
+	res.Msg = r.Msg.Copy()
+	return &res
+}
+
+// cacheLifetime is the smallest answer TTL, or for NXDOMAIN and NODATA the
+// negative TTL min(SOA TTL, SOA minimum) from the authority section
+func cacheLifetime(m *dns.Msg) time.Duration {
+	var ttl uint32
+	switch {
+	case m.Rcode == dns.RcodeSuccess && len(m.Answer) > 0:
+		for i, rr := range m.Answer {
+			if t := rr.Header().Ttl; i == 0 || t < ttl {
+				ttl = t
+			}
+		}
+	case m.Rcode == dns.RcodeSuccess || m.Rcode == dns.RcodeNameError:
+		found := false
+		for _, rr := range m.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				ttl, found = min(soa.Hdr.Ttl, soa.Minttl), true
+				break
+			}
+		}
+		if !found {
+			return 0
+		}
+	default:
+		return 0
+	}
+	return min(time.Duration(ttl)*time.Second, dnsCacheMaxTTL)
+}
+
+// dnsCacheInfo describes one entry for GET /api/dns/cache
+type dnsCacheInfo struct {
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	Server    string    `json:"server"`
+	Transport string    `json:"transport"`
+	Rcode     string    `json:"rcode"`
+	Answers   int       `json:"answers"`
+	Stored    time.Time `json:"stored"`
+	TTL       int       `json:"ttl"` // seconds left
+}
+
+// list returns the live entries, most recently used first
+func (c *dnsResultCache) list() []dnsCacheInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	out := []dnsCacheInfo{}
+	for el := c.lru.Front(); el != nil; el = el.Next() {
+		e := el.Value.(*dnsCacheEntry)
+		if !now.Before(e.expires) {
+			continue
+		}
+		out = append(out, dnsCacheInfo{
+			Name:      e.name,
+			Type:      e.typ,
+			Server:    e.server,
+			Transport: e.transport,
+			Rcode:     dns.RcodeToString[e.result.Msg.Rcode],
+			Answers:   len(e.result.Msg.Answer),
+			Stored:    e.stored,
+			TTL:       int(e.expires.Sub(now).Seconds()),
+		})
+	}
+	return out
+}
+
+// flush removes the entries matching name and server ("" matches all) and
+// returns how many were removed
+func (c *dnsResultCache) flush(name, server string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for key, el := range c.entries {
+		e := el.Value.(*dnsCacheEntry)
+		if (name == "" || e.name == name) && (server == "" || e.server == server) {
+			c.lru.Remove(el)
+			delete(c.entries, key)
+			n++
+		}
+	}
+	return n
+}
+
+// cacheName normalises an owner name for the cache; IPs stand for their
+// reverse name as in PTR lookups
+func cacheName(name string) string {
+	if ip := net.ParseIP(name); ip != nil {
+		name = reverseIP(ip)
+	}
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// apiDNSCacheHandler handles GET /api/dns/cache
+func apiDNSCacheHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	entries := dnsCache.list()
+	dnsCache.mu.Lock()
+	hits, misses := dnsCache.hits, dnsCache.misses
+	dnsCache.mu.Unlock()
+	data, _ := json.Marshal(map[string]interface{}{
+		"size":     len(entries),
+		"capacity": dnsCacheSize,
+		"hits":     hits,
+		"misses":   misses,
+		"entries":  entries,
+	})
+	fmt.Fprint(w, string(data))
+}
+
+// apiDNSCacheFlushHandler handles POST /api/dns/cache/flush?name=...&server=...
+// for admins; without parameters the whole cache is emptied
+func apiDNSCacheFlushHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name != "" {
+		name = cacheName(name)
+	}
+	server := strings.TrimSpace(r.FormValue("server"))
+	if server != "" {
+		// stored as queryDNS reports it: host:port for plain servers
+		server = chooseServer(server)
+		if up, err := parseUpstream(server); err == nil && up.Proto == "udp" {
+			server = up.Addr
+		}
+	}
+	fmt.Fprintf(w, `{"flushed":%d}`, dnsCache.flush(name, server))
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testMsg builds a response with the given rcode and records
+func testMsg(t *testing.T, rcode int, answer, ns []string) *dns.Msg {
+	t.Helper()
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	m.Response, m.Rcode = true, rcode
+	for _, s := range answer {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Answer = append(m.Answer, rr)
+	}
+	for _, s := range ns {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Ns = append(m.Ns, rr)
+	}
+	return m
+}
+
+func TestCacheLifetime(t *testing.T) {
+	soa := func(ttl, minimum string) string {
+		return "example.com. " + ttl + " IN SOA ns.example.com. hostmaster.example.com. 1 7200 3600 1209600 " + minimum
+	}
+	tests := []struct {
+		name   string
+		rcode  int
+		answer []string
+		ns     []string
+		want   time.Duration
+	}{
+		{"smallest answer ttl", dns.RcodeSuccess, []string{"example.com. 300 IN A 192.0.2.1", "example.com. 60 IN A 192.0.2.2"}, nil, 60 * time.Second},
+		{"capped at an hour", dns.RcodeSuccess, []string{"example.com. 86400 IN A 192.0.2.1"}, nil, time.Hour},
+		{"ttl 0 is not cached", dns.RcodeSuccess, []string{"example.com. 0 IN A 192.0.2.1"}, nil, 0},
+		{"nxdomain uses the soa minimum", dns.RcodeNameError, nil, []string{soa("3600", "300")}, 300 * time.Second},
+		{"nodata uses the soa ttl when smaller", dns.RcodeSuccess, nil, []string{soa("120", "300")}, 120 * time.Second},
+		{"negative answer without soa", dns.RcodeNameError, nil, nil, 0},
+		{"servfail", dns.RcodeServerFailure, nil, []string{soa("3600", "300")}, 0},
+		{"refused", dns.RcodeRefused, nil, nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cacheLifetime(testMsg(t, tt.rcode, tt.answer, tt.ns)); got != tt.want {
+				t.Errorf("cacheLifetime = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDNSResultCacheEviction(t *testing.T) {
+	c := newDNSResultCache(2)
+	put := func(key string) {
+		msg := testMsg(t, dns.RcodeSuccess, []string{"example.com. 300 IN A 192.0.2.1"}, nil)
+		c.put(&dnsCacheEntry{key: key, result: &dnsResult{Msg: msg}})
+	}
+	put("a")
+	put("b")
+	if _, ok := c.get("a"); !ok { // a is now the most recently used
+		t.Fatal("a missing before eviction")
+	}
+	put("c")
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, ok := c.get(key); ok != want {
+			t.Errorf("get(%q) ok = %v, want %v", key, ok, want)
+		}
+	}
+	if c.lru.Len() != 2 || len(c.entries) != 2 {
+		t.Errorf("cache holds %d/%d entries, want 2", c.lru.Len(), len(c.entries))
+	}
+
+	// a hit is a copy marked as cached; changing it leaves the entry alone
+	hit, _ := c.get("a")
+	if !hit.result.Cached {
+		t.Error("hit not marked as cached")
+	}
+	hit.result.Msg.Answer[0].Header().Ttl = 1
+	if again, _ := c.get("a"); again.result.Msg.Answer[0].Header().Ttl != 300 {
+		t.Errorf("cached ttl = %d after modifying a hit, want 300", again.result.Msg.Answer[0].Header().Ttl)
+	}
+}
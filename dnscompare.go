@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// compareAnswer is one answer record in presentation form
+type compareAnswer struct {
+	Type string `json:"type"`
+	TTL  uint32 `json:"ttl"`
+	Data string `json:"data"`
+}
+
+// compareResolver is the result of one resolver. Missing and Extra list the
+// answers ("TYPE data") that differ from the consensus.
+type compareResolver struct {
+	Server  string          `json:"server"`
+	Source  string          `json:"source"` // system or custom
+	Rcode   string          `json:"rcode,omitempty"`
+	Answers []compareAnswer `json:"answers"`
+	MinTTL  uint32          `json:"min_ttl"`
+	MaxTTL  uint32          `json:"max_ttl"`
+	RTT     float64         `json:"rtt"` // ms
+	Error   string          `json:"error,omitempty"`
+	Match   bool            `json:"match"`
+	Missing []string        `json:"missing,omitempty"`
+	Extra   []string        `json:"extra,omitempty"`
+
+	keys []string // sorted "TYPE data" of the answers
+	set  string   // rcode and keys, identifies the answer set
+}
+
+// apiDNSCompareHandler handles GET /api/dns/compare?name=...&type=...: the
+// query is sent to every system and custom resolver in parallel (bypassing
+// the cache) and each answer set is compared against the majority.
+func apiDNSCompareHandler(cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		name := r.URL.Query().Get("name")
+		typ := strings.ToUpper(r.URL.Query().Get("type"))
+		if name == "" || typ == "" {
+			fmt.Fprint(w, `{"error":"name and type are required"}`)
+			return
+		}
+
+		resolvers := compareResolvers(cfg)
+		if len(resolvers) == 0 {
+			fmt.Fprint(w, `{"error":"no resolvers configured"}`)
+			return
+		}
+		opts := dnsOptions{BufSize: cfg.DNS.EDNSBufSize, NoCache: true}
+		var wg sync.WaitGroup
+		for i := range resolvers {
+			wg.Add(1)
+			go func(c *compareResolver) {
+				defer wg.Done()
+				res, err := queryDNS(r.Context(), name, typ, c.Server, opts)
+				c.Server = res.Server
+				if res.Msg == nil {
+					c.Error = err.Error()
+					return
+				}
+				c.fill(res)
+			}(&resolvers[i])
+		}
+		wg.Wait()
+
+		consensus := compareConsensus(resolvers)
+		consistent := consensus != nil
+		for i := range resolvers {
+			c := &resolvers[i]
+			if c.Rcode == "" {
+				consistent = false
+				continue
+			}
+			c.diff(consensus)
+			consistent = consistent && c.Match
+		}
+
+		out := map[string]interface{}{
+			"name":       name,
+			"type":       typ,
+			"resolvers":  resolvers,
+			"consistent": consistent,
+		}
+		if consensus != nil {
+			out["consensus"] = map[string]interface{}{"rcode": consensus.Rcode, "answers": append([]string{}, consensus.keys...)}
+		}
+		data, _ := json.Marshal(out)
+		fmt.Fprint(w, string(data))
+	}
+}
+
+// compareResolvers lists the system resolvers followed by the custom ones,
+// without duplicates
+func compareResolvers(cfg *Config) []compareResolver {
+	var out []compareResolver
+	seen := make(map[string]bool)
+	add := func(server, source string) {
+		if !seen[server] {
+			seen[server] = true
+			out = append(out, compareResolver{Server: server, Source: source, Answers: []compareAnswer{}})
+		}
+	}
+	for _, s := range collectDNSServers() {
+		if net.ParseIP(s) != nil {
+			add(net.JoinHostPort(s, "53"), "system")
+		}
+	}
+	for _, s := range cfg.DNS.CustomServers {
+		if !strings.Contains(s, "://") {
+			if _, _, err := net.SplitHostPort(s); err != nil {
+				s = net.JoinHostPort(s, "53")
+			}
+		}
+		add(s, "custom")
+	}
+	return out
+}
+
+// fill copies the answer section of res; NXDOMAIN is compared like any
+// other answer
+func (c *compareResolver) fill(res *dnsResult) {
+	m := res.Msg
+	c.Rcode = dns.RcodeToString[m.Rcode]
+	c.RTT = float64(res.RTT) / float64(time.Millisecond)
+	for i, rr := range m.Answer {
+		h := rr.Header()
+		a := compareAnswer{Type: dns.Type(h.Rrtype).String(), TTL: h.Ttl, Data: rdataString(rr)}
+		c.Answers = append(c.Answers, a)
+		c.keys = append(c.keys, a.Type+" "+a.Data)
+		if i == 0 || h.Ttl < c.MinTTL {
+			c.MinTTL = h.Ttl
+		}
+		if h.Ttl > c.MaxTTL {
+			c.MaxTTL = h.Ttl
+		}
+	}
+	sort.Strings(c.keys)
+	// the rcode is part of the set so NXDOMAIN and empty NOERROR differ;
+	// TTLs are not, they count down in caches
+	c.set = strings.ToLower(c.Rcode + "\n" + strings.Join(c.keys, "\n"))
+}
+
+// compareConsensus returns the resolver whose answer set was returned most
+// often (nil if no resolver answered)
+func compareConsensus(resolvers []compareResolver) *compareResolver {
+	count := make(map[string]int)
+	var best *compareResolver
+	for i := range resolvers {
+		c := &resolvers[i]
+		if c.Rcode == "" {
+			continue
+		}
+		count[c.set]++
+		if best == nil || count[c.set] > count[best.set] {
+			best = c
+		}
+	}
+	return best
+}
+
+// diff marks the resolver as matching or lists its differences
+func (c *compareResolver) diff(consensus *compareResolver) {
+	c.Match = c.set == consensus.set
+	if c.Match {
+		return
+	}
+	c.Missing = missingKeys(consensus.keys, c.keys)
+	c.Extra = missingKeys(c.keys, consensus.keys)
+}
+
+// missingKeys returns the entries of want that are not in have
+func missingKeys(want, have []string) []string {
+	in := make(map[string]bool, len(have))
+	for _, k := range have {
+		in[strings.ToLower(k)] = true
+	}
+	var out []string
+	for _, k := range want {
+		if !in[strings.ToLower(k)] {
+			out = append(out, k)
+		}
+	}
+	return out
+}
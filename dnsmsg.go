@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dnsResult is one completed query together with how it was made
+type dnsResult struct {
+	Server    string
+	Transport string // udp, tcp, ...
+	Qtype     uint16
+	Msg       *dns.Msg
+	RTT       time.Duration
+	When      time.Time
+	Truncated bool   // the UDP answer had TC=1 and was retried over TCP
+	Cached    bool   // served from dnsCache, TTLs reduced by the time spent there
+	Cookie    string // client cookie sent, checked against the one echoed
+}
+
+// dnsFlags are the header bits of a response
+type dnsFlags struct {
+	QR bool `json:"qr"`
+	AA bool `json:"aa"`
+	TC bool `json:"tc"`
+	RD bool `json:"rd"`
+	RA bool `json:"ra"`
+	AD bool `json:"ad"`
+	CD bool `json:"cd"`
+}
+
+// dnsQuestion is one entry of the question section
+type dnsQuestion struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Class string `json:"class"`
+}
+
+// dnsRecord is one resource record of any section, RDATA as in recordToMap
+type dnsRecord struct {
+	Name  string                 `json:"name"`
+	Type  string                 `json:"type"`
+	Class string                 `json:"class"`
+	TTL   uint32                 `json:"ttl"`
+	Data  map[string]interface{} `json:"data"`
+}
+
+// dnsEDNSOption is one option of the OPT pseudo-record
+type dnsEDNSOption struct {
+	Code   uint16                 `json:"code"`
+	Name   string                 `json:"name"`
+	Data   string                 `json:"data"`
+	Fields map[string]interface{} `json:"fields,omitempty"` // decoded ECS, NSID, COOKIE, EDE, …
+}
+
+// dnsEDNS describes the OPT pseudo-record of a response
+type dnsEDNS struct {
+	Version uint8           `json:"version"`
+	UDPSize uint16          `json:"udp_size"`
+	DO      bool            `json:"do"`
+	Options []dnsEDNSOption `json:"options,omitempty"`
+}
+
+// dnsQueryResponse is the JSON answer of /api/dns
+type dnsQueryResponse struct {
+	Error      string                   `json:"error,omitempty"`
+	Server     string                   `json:"server"`
+	Records    []map[string]interface{} `json:"records"`
+	Rcode      string                   `json:"rcode"`
+	ID         uint16                   `json:"id"`
+	Opcode     string                   `json:"opcode"`
+	Flags      dnsFlags                 `json:"flags"`
+	Question   []dnsQuestion            `json:"question"`
+	Answer     []dnsRecord              `json:"answer"`
+	Authority  []dnsRecord              `json:"authority"`
+	Additional []dnsRecord              `json:"additional"`
+	EDNS       *dnsEDNS                 `json:"edns,omitempty"`
+	RTT        float64                  `json:"rtt"` // ms
+	Size       int                      `json:"size"`
+	Transport  string                   `json:"transport"`
+	Truncated  bool                     `json:"truncated"`    // a TC=1 answer was received
+	Fallback   bool                     `json:"tcp_fallback"` // and retried over TCP
+	Cached     bool                     `json:"cached"`
+}
+
+// ednsOptionNames maps EDNS0 option codes to their mnemonics
+var ednsOptionNames = map[uint16]string{
+	dns.EDNS0LLQ:          "LLQ",
+	dns.EDNS0UL:           "UL",
+	dns.EDNS0NSID:         "NSID",
+	dns.EDNS0DAU:          "DAU",
+	dns.EDNS0DHU:          "DHU",
+	dns.EDNS0N3U:          "N3U",
+	dns.EDNS0SUBNET:       "ECS",
+	dns.EDNS0EXPIRE:       "EXPIRE",
+	dns.EDNS0COOKIE:       "COOKIE",
+	dns.EDNS0TCPKEEPALIVE: "TCP-KEEPALIVE",
+	dns.EDNS0PADDING:      "PADDING",
+	dns.EDNS0EDE:          "EDE",
+}
+
+// answerRecords returns the structured RDATA of the answers matching qtype.
+// ANY returns every type, so each record is tagged with its type.
+func answerRecords(msg *dns.Msg, qtype uint16) []map[string]interface{} {
+	var out []map[string]interface{}
+	for _, ans := range msg.Answer {
+		if qtype == dns.TypeANY {
+			rec := recordToMap(ans)
+			rec["type"] = dns.Type(ans.Header().Rrtype).String()
+			out = append(out, rec)
+		} else if ans.Header().Rrtype == qtype {
+			out = append(out, recordToMap(ans))
+		}
+	}
+	return out
+}
+
+// response converts the result into the dig-style JSON answer
+func (r *dnsResult) response() dnsQueryResponse {
+	m := r.Msg
+	out := dnsQueryResponse{
+		Server:  r.Server,
+		Records: answerRecords(m, r.Qtype),
+		Rcode:   dns.RcodeToString[m.Rcode],
+		ID:      m.Id,
+		Opcode:  dns.OpcodeToString[m.Opcode],
+		Flags: dnsFlags{
+			QR: m.Response,
+			AA: m.Authoritative,
+			TC: m.Truncated,
+			RD: m.RecursionDesired,
+			RA: m.RecursionAvailable,
+			AD: m.AuthenticatedData,
+			CD: m.CheckingDisabled,
+		},
+		Question:   []dnsQuestion{},
+		Answer:     sectionRecords(m.Answer),
+		Authority:  sectionRecords(m.Ns),
+		Additional: sectionRecords(m.Extra),
+		RTT:        float64(r.RTT) / float64(time.Millisecond),
+		Size:       m.Len(),
+		Transport:  r.Transport,
+		Truncated:  r.Truncated || m.Truncated,
+		Fallback:   r.Truncated,
+		Cached:     r.Cached,
+	}
+	for _, q := range m.Question {
+		out.Question = append(out.Question, dnsQuestion{
+			Name:  q.Name,
+			Type:  dns.Type(q.Qtype).String(),
+			Class: dns.Class(q.Qclass).String(),
+		})
+	}
+	if opt := m.IsEdns0(); opt != nil {
+		out.EDNS = &dnsEDNS{Version: opt.Version(), UDPSize: opt.UDPSize(), DO: opt.Do()}
+		for _, o := range opt.Option {
+			name, ok := ednsOptionNames[o.Option()]
+			if !ok {
+				name = fmt.Sprintf("OPT%d", o.Option())
+			}
+			out.EDNS.Options = append(out.EDNS.Options, dnsEDNSOption{Code: o.Option(), Name: name, Data: o.String(), Fields: ednsOptionFields(o, r.Cookie)})
+		}
+	}
+	return out
+}
+
+// ednsOptionFields decodes the options noc2go knows; sent is the client
+// cookie of the query
+func ednsOptionFields(o dns.EDNS0, sent string) map[string]interface{} {
+	switch o := o.(type) {
+	case *dns.EDNS0_NSID:
+		b, _ := hex.DecodeString(o.Nsid)
+		return map[string]interface{}{"hex": o.Nsid, "text": printable(string(b))}
+	case *dns.EDNS0_SUBNET:
+		out := map[string]interface{}{
+			"family":        o.Family,
+			"source_prefix": o.SourceNetmask,
+			"scope_prefix":  o.SourceScope,
+		}
+		if addr, ok := netip.AddrFromSlice(o.Address); ok {
+			out["subnet"] = netip.PrefixFrom(addr.Unmap(), int(o.SourceNetmask)).Masked().String()
+		}
+		return out
+	case *dns.EDNS0_COOKIE:
+		c := strings.ToLower(o.Cookie)
+		out := map[string]interface{}{"client": c[:min(16, len(c))]}
+		if len(c) > 16 {
+			out["server"] = c[16:]
+		}
+		if sent != "" {
+			out["client_match"] = out["client"] == sent
+		}
+		return out
+	case *dns.EDNS0_EDE:
+		return map[string]interface{}{
+			"info_code":  o.InfoCode,
+			"purpose":    dns.ExtendedErrorCodeToString[o.InfoCode],
+			"extra_text": o.ExtraText,
+		}
+	case *dns.EDNS0_EXPIRE:
+		return map[string]interface{}{"expire": o.Expire}
+	case *dns.EDNS0_TCP_KEEPALIVE:
+		return map[string]interface{}{"timeout_ms": int(o.Timeout) * 100}
+	case *dns.EDNS0_PADDING:
+		return map[string]interface{}{"length": len(o.Padding)}
+	}
+	return nil
+}
+
+// printable replaces control and non-ASCII bytes with '.' as dig does for NSID
+func printable(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if c < 0x20 || c > 0x7e {
+			b[i] = '.'
+		}
+	}
+	return string(b)
+}
+
+// sectionRecords converts a message section, leaving out the OPT pseudo-record
+func sectionRecords(rrs []dns.RR) []dnsRecord {
+	out := []dnsRecord{}
+	for _, rr := range rrs {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeOPT {
+			continue
+		}
+		out = append(out, dnsRecord{
+			Name:  h.Name,
+			Type:  dns.Type(h.Rrtype).String(),
+			Class: dns.Class(h.Class).String(),
+			TTL:   h.Ttl,
+			Data:  recordToMap(rr),
+		})
+	}
+	return out
+}
+
+// writeDig writes the result in the textual form known from dig
+func writeDig(w io.Writer, r *dnsResult, name, typ string) {
+	fmt.Fprintf(w, "; <<>> noc2go <<>> %s %s @%s\n", name, typ, r.Server)
+	fmt.Fprint(w, r.Msg.String())
+	fmt.Fprintf(w, "\n;; Query time: %d msec\n", r.RTT.Milliseconds())
+	fmt.Fprintf(w, ";; SERVER: %s (%s)\n", r.Server, strings.ToUpper(r.Transport))
+	if r.Truncated {
+		fmt.Fprintln(w, ";; Truncated, retried in TCP mode.")
+	}
+	fmt.Fprintf(w, ";; WHEN: %s\n", r.When.Format(time.UnixDate))
+	if r.Cached {
+		fmt.Fprintln(w, ";; Served from the noc2go cache.")
+	}
+	fmt.Fprintf(w, ";; MSG SIZE  rcvd: %d\n", r.Msg.Len())
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"math"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// unsupportedQueryTypes are meta types that make no sense in a plain lookup
+var unsupportedQueryTypes = map[uint16]bool{
+	dns.TypeAXFR: true,
+	dns.TypeIXFR: true,
+	dns.TypeOPT:  true,
+	dns.TypeTSIG: true,
+	dns.TypeTKEY: true,
+}
+
+// dnssecQueryTypes are only returned by most servers when the DO bit is set
+var dnssecQueryTypes = map[uint16]bool{
+	dns.TypeRRSIG:  true,
+	dns.TypeDNSKEY: true,
+	dns.TypeDS:     true,
+	dns.TypeNSEC:   true,
+	dns.TypeNSEC3:  true,
+}
+
+// recordToMap converts one resource record to its structured JSON form.
+// Types without a dedicated mapping keep their presentation format in "data".
+func recordToMap(rr dns.RR) map[string]interface{} {
+	switch rr := rr.(type) {
+	case *dns.A:
+		return map[string]interface{}{"address": rr.A.String()}
+	case *dns.AAAA:
+		return map[string]interface{}{"address": rr.AAAA.String()}
+	case *dns.MX:
+		return map[string]interface{}{"host": rr.Mx, "priority": rr.Preference}
+	case *dns.NS:
+		return map[string]interface{}{"host": rr.Ns}
+	case *dns.PTR:
+		return map[string]interface{}{"host": rr.Ptr}
+	case *dns.TXT:
+		return map[string]interface{}{"text": strings.Join(rr.Txt, "")}
+	case *dns.SRV:
+		return map[string]interface{}{
+			"target":   rr.Target,
+			"port":     rr.Port,
+			"priority": rr.Priority,
+			"weight":   rr.Weight,
+		}
+	case *dns.CNAME:
+		return map[string]interface{}{"target": rr.Target}
+	case *dns.DNAME:
+		return map[string]interface{}{"target": rr.Target}
+	case *dns.SOA:
+		return map[string]interface{}{
+			"mname":   rr.Ns,
+			"rname":   rr.Mbox,
+			"serial":  rr.Serial,
+			"refresh": rr.Refresh,
+			"retry":   rr.Retry,
+			"expire":  rr.Expire,
+			"minimum": rr.Minttl,
+		}
+	case *dns.CAA:
+		return map[string]interface{}{"flag": rr.Flag, "tag": rr.Tag, "value": rr.Value}
+	case *dns.DS:
+		return map[string]interface{}{
+			"key_tag":     rr.KeyTag,
+			"algorithm":   dns.AlgorithmToString[rr.Algorithm],
+			"digest_type": dns.HashToString[rr.DigestType],
+			"digest":      rr.Digest,
+		}
+	case *dns.DNSKEY:
+		return map[string]interface{}{
+			"flags":      rr.Flags,
+			"protocol":   rr.Protocol,
+			"algorithm":  dns.AlgorithmToString[rr.Algorithm],
+			"key_tag":    rr.KeyTag(),
+			"sep":        rr.Flags&dns.SEP != 0,
+			"public_key": rr.PublicKey,
+		}
+	case *dns.RRSIG:
+		return map[string]interface{}{
+			"type_covered": dns.TypeToString[rr.TypeCovered],
+			"algorithm":    dns.AlgorithmToString[rr.Algorithm],
+			"labels":       rr.Labels,
+			"original_ttl": rr.OrigTtl,
+			"expiration":   dns.TimeToString(rr.Expiration),
+			"inception":    dns.TimeToString(rr.Inception),
+			"key_tag":      rr.KeyTag,
+			"signer":       rr.SignerName,
+			"signature":    rr.Signature,
+		}
+	case *dns.NSEC:
+		return map[string]interface{}{"next_domain": rr.NextDomain, "types": typeNames(rr.TypeBitMap)}
+	case *dns.NSEC3:
+		return map[string]interface{}{
+			"hash_algorithm": rr.Hash,
+			"flags":          rr.Flags,
+			"iterations":     rr.Iterations,
+			"salt":           rr.Salt,
+			"next_domain":    rr.NextDomain,
+			"types":          typeNames(rr.TypeBitMap),
+		}
+	case *dns.TLSA:
+		return map[string]interface{}{
+			"usage":         rr.Usage,
+			"selector":      rr.Selector,
+			"matching_type": rr.MatchingType,
+			"certificate":   rr.Certificate,
+		}
+	case *dns.SSHFP:
+		return map[string]interface{}{
+			"algorithm":   rr.Algorithm,
+			"fp_type":     rr.Type,
+			"fingerprint": rr.FingerPrint,
+		}
+	case *dns.NAPTR:
+		return map[string]interface{}{
+			"order":       rr.Order,
+			"preference":  rr.Preference,
+			"flags":       rr.Flags,
+			"service":     rr.Service,
+			"regexp":      rr.Regexp,
+			"replacement": rr.Replacement,
+		}
+	case *dns.HTTPS:
+		return svcbToMap(&rr.SVCB)
+	case *dns.SVCB:
+		return svcbToMap(rr)
+	case *dns.LOC:
+		return map[string]interface{}{
+			"latitude":  float64(int64(rr.Latitude)-dns.LOC_EQUATOR) / 3600000,
+			"longitude": float64(int64(rr.Longitude)-dns.LOC_PRIMEMERIDIAN) / 3600000,
+			"altitude":  float64(int64(rr.Altitude)-dns.LOC_ALTITUDEBASE*100) / 100,
+			"size":      locPrecision(rr.Size),
+			"horiz_pre": locPrecision(rr.HorizPre),
+			"vert_pre":  locPrecision(rr.VertPre),
+		}
+	case *dns.HINFO:
+		return map[string]interface{}{"cpu": rr.Cpu, "os": rr.Os}
+	}
+	return map[string]interface{}{"data": rdataString(rr)}
+}
+
+// svcbToMap renders SVCB and HTTPS records; params keep their presentation form
+func svcbToMap(rr *dns.SVCB) map[string]interface{} {
+	params := make(map[string]string, len(rr.Value))
+	for _, kv := range rr.Value {
+		params[kv.Key().String()] = kv.String()
+	}
+	return map[string]interface{}{
+		"priority": rr.Priority,
+		"target":   rr.Target,
+		"params":   params,
+	}
+}
+
+// locPrecision decodes the mantissa/exponent size fields of LOC into meters
+func locPrecision(v uint8) float64 {
+	return float64(v>>4) * math.Pow10(int(v&0x0f)) / 100
+}
+
+// typeNames converts an NSEC/NSEC3 type bitmap into mnemonics
+func typeNames(types []uint16) []string {
+	out := make([]string, 0, len(types))
+	for _, t := range types {
+		out = append(out, dns.Type(t).String())
+	}
+	return out
+}
+
+// rdataString returns the presentation format of rr without the owner,
+// TTL, class and type columns
+func rdataString(rr dns.RR) string {
+	return strings.TrimSpace(strings.TrimPrefix(rr.String(), rr.Header().String()))
+}
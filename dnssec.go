@@ -0,0 +1,797 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	dnssecTimeout       = 30 * time.Second
+	dnssecExpiryWarning = 7 * 24 * time.Hour
+)
+
+// rootTrustAnchors are the DS records of the root KSKs (KSK-2017, KSK-2024);
+// Config.DNS.TrustAnchors replaces them
+var rootTrustAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// dnssecDigests and dnssecAlgorithms are the DS digest types and DNSKEY
+// algorithms the validator implements. A zone whose DS records use none of
+// them has no supported authentication path and is insecure (RFC 4035 5.2).
+var (
+	dnssecDigests    = map[uint8]bool{dns.SHA1: true, dns.SHA256: true, dns.SHA384: true}
+	dnssecAlgorithms = map[uint8]bool{
+		dns.RSASHA1: true, dns.RSASHA1NSEC3SHA1: true, dns.RSASHA256: true, dns.RSASHA512: true,
+		dns.ECDSAP256SHA256: true, dns.ECDSAP384SHA384: true, dns.ED25519: true,
+	}
+)
+
+// dnssecDS is one DS record of a delegation
+type dnssecDS struct {
+	KeyTag     uint16 `json:"key_tag"`
+	Algorithm  string `json:"algorithm"`
+	DigestType string `json:"digest_type"`
+	Supported  bool   `json:"supported"` // digest type and algorithm are implemented
+	Matched    bool   `json:"matched"`   // a DNSKEY of the child has this digest
+}
+
+// dnssecKey is one DNSKEY of a zone
+type dnssecKey struct {
+	KeyTag    uint16 `json:"key_tag"`
+	Flags     uint16 `json:"flags"`
+	Algorithm string `json:"algorithm"`
+	SEP       bool   `json:"sep"`
+	DSMatch   bool   `json:"ds_match"`
+}
+
+// dnssecSig is one RRSIG and the outcome of its verification
+type dnssecSig struct {
+	RRset      string    `json:"rrset"`
+	KeyTag     uint16    `json:"key_tag"`
+	Signer     string    `json:"signer"`
+	Algorithm  string    `json:"algorithm"`
+	Inception  time.Time `json:"inception"`
+	Expiration time.Time `json:"expiration"`
+	ExpiresIn  float64   `json:"expires_in_days"`
+	Valid      bool      `json:"valid"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// dnssecStep is one zone of the chain of trust. Status is secure, insecure,
+// bogus or indeterminate.
+type dnssecStep struct {
+	Zone       string      `json:"zone"`
+	Status     string      `json:"status"`
+	DS         []dnssecDS  `json:"ds"`
+	Keys       []dnssecKey `json:"keys"`
+	Signatures []dnssecSig `json:"signatures"`
+	Problems   []string    `json:"problems,omitempty"`
+}
+
+// dnssecAnswer is the validation of the queried RRset itself. Chain lists
+// the zones outside the chain of the queried name that answer RRsets (CNAME
+// targets) were validated against.
+type dnssecAnswer struct {
+	Status     string       `json:"status"`
+	Rcode      string       `json:"rcode"`
+	Records    []dnsRecord  `json:"records"`
+	Signatures []dnssecSig  `json:"signatures"`
+	Chain      []dnssecStep `json:"chain,omitempty"`
+	Problems   []string     `json:"problems,omitempty"`
+}
+
+// dnssecReport is the JSON answer of /api/dns?dnssec=true
+type dnssecReport struct {
+	Name   string       `json:"name"`
+	Type   string       `json:"type"`
+	Server string       `json:"server"`
+	Status string       `json:"status"`
+	Chain  []dnssecStep `json:"chain"`
+	Answer dnssecAnswer `json:"answer"`
+}
+
+// dnssecValidator fetches DNSSEC records through one resolver with the CD
+// bit set, so bogus data is returned instead of SERVFAIL. Validated zones
+// are kept so chains sharing ancestors are built once.
+type dnssecValidator struct {
+	ctx      context.Context
+	up       *dnsUpstream
+	now      time.Time
+	anchors  []*dns.DS
+	steps    map[string]dnssecStep
+	keys     map[string][]*dns.DNSKEY
+	reported map[string]bool
+}
+
+// validateDNSSEC builds the chain of trust from the root trust anchors down
+// to the zone of name and validates the name/typ RRset against it
+func validateDNSSEC(ctx context.Context, cfg *Config, name, typ, override string) (*dnssecReport, error) {
+	lookupName, err := queryName(name, typ)
+	if err != nil {
+		return nil, err
+	}
+	qtype, err := parseQueryType(typ)
+	if err != nil {
+		return nil, err
+	}
+	anchors := rootTrustAnchors
+	if len(cfg.DNS.TrustAnchors) > 0 {
+		anchors = cfg.DNS.TrustAnchors
+	}
+	var ds []*dns.DS
+	for _, a := range anchors {
+		rr, err := dns.NewRR(a)
+		if err != nil {
+			return nil, fmt.Errorf("trust anchor %q: %v", a, err)
+		}
+		d, ok := rr.(*dns.DS)
+		if !ok || d.Hdr.Name != "." {
+			return nil, fmt.Errorf("trust anchor %q is not a root DS record", a)
+		}
+		ds = append(ds, d)
+	}
+
+	server := chooseServer(override)
+	up, err := parseUpstream(server)
+	if err != nil {
+		return nil, err
+	}
+	if up.Proto == "udp" {
+		server = up.Addr
+	}
+	ctx, cancel := context.WithTimeout(ctx, dnssecTimeout)
+	defer cancel()
+	v := &dnssecValidator{
+		ctx:      ctx,
+		up:       up,
+		now:      time.Now(),
+		anchors:  ds,
+		steps:    make(map[string]dnssecStep),
+		keys:     make(map[string][]*dns.DNSKEY),
+		reported: make(map[string]bool),
+	}
+
+	qname := dns.CanonicalName(dns.Fqdn(lookupName))
+	report := &dnssecReport{Name: qname, Type: dns.Type(qtype).String(), Server: server}
+	zones, err := v.zoneCuts(qname)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []*dns.DNSKEY
+	var status string
+	report.Chain, keys, status = v.chain(zones)
+	report.Answer = v.answer(qname, qtype, zones[len(zones)-1], keys, status)
+	report.Status = report.Answer.Status
+	return report, nil
+}
+
+// query sends name/qtype with DO and CD set, retrying truncated answers over TCP
+func (v *dnssecValidator) query(name string, qtype uint16) (*dns.Msg, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, qtype)
+	msg.CheckingDisabled = true
+	msg.SetEdns0(defaultEDNSBufSize, true)
+	up := *v.up
+	resp, _, err := up.exchange(v.ctx, msg)
+	if err == nil && resp.Truncated && up.Proto == "udp" {
+		up.Proto = "tcp"
+		resp, _, err = up.exchange(v.ctx, msg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return resp, fmt.Errorf("%s %s: %s", name, dns.Type(qtype), dns.RcodeToString[resp.Rcode])
+	}
+	return resp, nil
+}
+
+// chain validates zones from the root down and returns the steps not
+// reported before, the keys of the last zone and its status
+func (v *dnssecValidator) chain(zones []string) ([]dnssecStep, []*dns.DNSKEY, string) {
+	var steps []dnssecStep
+	var keys []*dns.DNSKEY
+	status := "secure"
+	for i, zone := range zones {
+		step, ok := v.steps[zone]
+		if ok {
+			keys = v.keys[zone]
+		} else if i == 0 {
+			step, keys = v.zoneStep(zone, v.anchors, nil, status)
+		} else {
+			step, keys = v.delegationStep(zone, zones[i-1], keys, status)
+		}
+		v.steps[zone], v.keys[zone] = step, keys
+		status = step.Status
+		if !v.reported[zone] {
+			v.reported[zone] = true
+			steps = append(steps, step)
+		}
+	}
+	return steps, keys, status
+}
+
+// zoneCuts returns the zone apexes from the root down to the zone holding
+// qname, found by asking for the SOA of every ancestor
+func (v *dnssecValidator) zoneCuts(qname string) ([]string, error) {
+	zones := []string{"."}
+	labels := dns.SplitDomainName(qname)
+	for i := len(labels) - 1; i >= 0; i-- {
+		n := dns.Fqdn(strings.Join(labels[i:], "."))
+		resp, err := v.query(n, dns.TypeSOA)
+		if err != nil {
+			return nil, err
+		}
+		for _, rr := range resp.Answer {
+			if soa, ok := rr.(*dns.SOA); ok && dns.CanonicalName(soa.Hdr.Name) == n {
+				zones = append(zones, n)
+				break
+			}
+		}
+	}
+	return zones, nil
+}
+
+// delegationStep fetches the DS set of zone from parent, validates it with
+// the parent's keys and continues with zoneStep
+func (v *dnssecValidator) delegationStep(zone, parent string, parentKeys []*dns.DNSKEY, parentStatus string) (dnssecStep, []*dns.DNSKEY) {
+	resp, err := v.query(zone, dns.TypeDS)
+	if err != nil {
+		step, keys := v.zoneStep(zone, nil, nil, parentStatus)
+		step.Problems = append(step.Problems, "DS lookup failed: "+err.Error())
+		if parentStatus == "secure" {
+			step.Status = "indeterminate"
+		}
+		return step, keys
+	}
+	rrset, sigs := rrsetOf(resp.Answer, zone, dns.TypeDS)
+	if len(rrset) == 0 {
+		// no DS: an insecure delegation if the parent proves it
+		step, keys := v.zoneStep(zone, nil, nil, parentStatus)
+		if parentStatus != "secure" {
+			return step, keys
+		}
+		proof, dsSigs, problems := v.denial(resp, zone, dns.TypeDS, parent, parentKeys)
+		step.Signatures = append(dsSigs, step.Signatures...)
+		step.Problems = append(problems, step.Problems...)
+		if proof {
+			step.Status = "insecure"
+			step.Problems = append(step.Problems, "no DS record at the parent: unsigned delegation")
+		} else {
+			step.Status = "bogus"
+			step.Problems = append(step.Problems, "no DS record and no signed proof of its absence")
+		}
+		return step, keys
+	}
+
+	var ds []*dns.DS
+	for _, rr := range rrset {
+		ds = append(ds, rr.(*dns.DS))
+	}
+	dsSigs, valid := v.verify(rrset, sigs, parent, parentKeys, "DS")
+	step, keys := v.zoneStep(zone, ds, dsSigs, parentStatus)
+	if parentStatus == "secure" && !valid {
+		step.Status = "bogus"
+		step.Problems = append(step.Problems, "DS RRset has no valid signature by "+parent)
+	}
+	return step, keys
+}
+
+// zoneStep fetches the DNSKEY set of zone, matches it against ds and
+// validates its self-signature with a DS-matched key
+func (v *dnssecValidator) zoneStep(zone string, ds []*dns.DS, sigs []dnssecSig, parentStatus string) (dnssecStep, []*dns.DNSKEY) {
+	step := dnssecStep{Zone: zone, Status: parentStatus, DS: []dnssecDS{}, Keys: []dnssecKey{}, Signatures: sigs}
+	if step.Signatures == nil {
+		step.Signatures = []dnssecSig{}
+	}
+
+	resp, err := v.query(zone, dns.TypeDNSKEY)
+	if err != nil {
+		step.Problems = append(step.Problems, "DNSKEY lookup failed: "+err.Error())
+		if parentStatus == "secure" && len(ds) > 0 {
+			step.Status = "indeterminate"
+		}
+		return step, nil
+	}
+	rrset, rrsigs := rrsetOf(resp.Answer, zone, dns.TypeDNSKEY)
+	var keys []*dns.DNSKEY
+	for _, rr := range rrset {
+		keys = append(keys, rr.(*dns.DNSKEY))
+	}
+
+	// which keys are vouched for by the parent
+	trusted := make(map[uint16]bool)
+	supported := false
+	for _, d := range ds {
+		e := dnssecDS{KeyTag: d.KeyTag, Algorithm: dns.AlgorithmToString[d.Algorithm], DigestType: dns.HashToString[d.DigestType]}
+		e.Supported = dnssecDigests[d.DigestType] && dnssecAlgorithms[d.Algorithm]
+		supported = supported || e.Supported
+		for _, k := range keys {
+			if !e.Supported {
+				break
+			}
+			if k.KeyTag() != d.KeyTag || k.Algorithm != d.Algorithm {
+				continue
+			}
+			if kd := k.ToDS(d.DigestType); kd != nil && strings.EqualFold(kd.Digest, d.Digest) {
+				e.Matched = true
+				trusted[k.KeyTag()] = true
+			}
+		}
+		step.DS = append(step.DS, e)
+	}
+	for _, k := range keys {
+		step.Keys = append(step.Keys, dnssecKey{
+			KeyTag:    k.KeyTag(),
+			Flags:     k.Flags,
+			Algorithm: dns.AlgorithmToString[k.Algorithm],
+			SEP:       k.Flags&dns.SEP != 0,
+			DSMatch:   trusted[k.KeyTag()],
+		})
+	}
+
+	// the RRset must be signed by a key the parent vouches for
+	keySigs, _ := v.verify(rrset, rrsigs, zone, keys, "DNSKEY")
+	valid := false
+	for _, s := range keySigs {
+		valid = valid || (s.Valid && trusted[s.KeyTag])
+	}
+	step.Signatures = append(step.Signatures, keySigs...)
+	step.Problems = append(step.Problems, v.expiryWarnings(keySigs)...)
+
+	if parentStatus != "secure" || len(ds) == 0 {
+		return step, keys
+	}
+	if !supported {
+		step.Status = "insecure"
+		step.Problems = append(step.Problems, "no DS record uses a supported digest type and algorithm: treated as unsigned")
+		return step, keys
+	}
+	switch {
+	case len(keys) == 0:
+		step.Status = "bogus"
+		step.Problems = append(step.Problems, "DS present but the zone has no DNSKEY")
+	case len(trusted) == 0:
+		step.Status = "bogus"
+		step.Problems = append(step.Problems, "DS mismatch: no DNSKEY matches the DS records")
+	case !valid:
+		step.Status = "bogus"
+		step.Problems = append(step.Problems, "DNSKEY RRset has no valid signature by a DS-matched key")
+	}
+	return step, keys
+}
+
+// answer validates the queried RRset, or for NXDOMAIN/NODATA the signatures
+// of the denial records, with the keys of its zone
+func (v *dnssecValidator) answer(qname string, qtype uint16, zone string, keys []*dns.DNSKEY, zoneStatus string) dnssecAnswer {
+	out := dnssecAnswer{Status: zoneStatus, Records: []dnsRecord{}, Signatures: []dnssecSig{}}
+	resp, err := v.query(qname, qtype)
+	if err != nil {
+		out.Problems = append(out.Problems, err.Error())
+		if zoneStatus == "secure" {
+			out.Status = "indeterminate"
+		}
+		return out
+	}
+	out.Rcode = dns.RcodeToString[resp.Rcode]
+	out.Records = sectionRecords(resp.Answer)
+	if zoneStatus == "insecure" {
+		return out
+	}
+
+	rrsets := 0
+	for _, key := range rrsetKeys(resp.Answer) {
+		rrset, sigs := rrsetOf(resp.Answer, key.name, key.rrtype)
+		rrsets++
+		label := dns.Type(key.rrtype).String()
+		signer := zone
+		if len(sigs) > 0 {
+			signer = dns.CanonicalName(sigs[0].SignerName)
+		}
+
+		// an RRset from another zone (a CNAME target) needs that zone's chain
+		rzone, rkeys, rstatus := zone, keys, zoneStatus
+		if signer != zone || (len(sigs) == 0 && dns.CanonicalName(key.name) != qname) {
+			zones, err := v.zoneCuts(dns.CanonicalName(key.name))
+			if err != nil {
+				out.Problems = append(out.Problems, fmt.Sprintf("%s %s is outside the validated chain and its zone could not be found: %v", key.name, label, err))
+				out.Status = worseStatus(out.Status, "indeterminate")
+				continue
+			}
+			var steps []dnssecStep
+			steps, rkeys, rstatus = v.chain(zones)
+			rzone = zones[len(zones)-1]
+			out.Chain = append(out.Chain, steps...)
+			if rzone != zone {
+				out.Problems = append(out.Problems, fmt.Sprintf("%s %s is in zone %s (%s)", key.name, label, rzone, rstatus))
+			}
+		}
+		out.Status = worseStatus(out.Status, rstatus)
+		if rstatus == "insecure" {
+			continue
+		}
+		if len(sigs) > 0 && signer != rzone {
+			out.Problems = append(out.Problems, fmt.Sprintf("%s %s is signed by %s instead of its zone %s", key.name, label, signer, rzone))
+			out.Status = "bogus"
+			continue
+		}
+		s, ok := v.verify(rrset, sigs, rzone, rkeys, label)
+		out.Signatures = append(out.Signatures, s...)
+		if rstatus == "secure" && !ok {
+			out.Status = "bogus"
+		}
+		// a wildcard expansion needs proof that no closer name exists
+		if labels, expanded := wildcardLabels(key.name, sigs); rstatus == "secure" && ok && expanded {
+			nsecs, s := v.denialRecords(resp, rzone, rkeys)
+			out.Signatures = append(out.Signatures, s...)
+			if !provesExpansion(nsecs, key.name, labels) {
+				out.Problems = append(out.Problems, fmt.Sprintf("%s %s is expanded from a wildcard without NSEC/NSEC3 proof that the name does not exist (RFC 4035 5.3.4)", key.name, label))
+				out.Status = "bogus"
+			}
+		}
+	}
+	if rrsets == 0 {
+		proof, s, problems := v.denial(resp, qname, qtype, zone, keys)
+		out.Signatures = append(out.Signatures, s...)
+		out.Problems = append(out.Problems, problems...)
+		if zoneStatus == "secure" && !proof {
+			out.Status = "bogus"
+		}
+	}
+	out.Problems = append(out.Problems, v.expiryWarnings(out.Signatures)...)
+	return out
+}
+
+// worseStatus returns the weaker of two validation results; an answer is
+// only as secure as the least secure RRset in it
+func worseStatus(a, b string) string {
+	rank := map[string]int{"secure": 0, "insecure": 1, "indeterminate": 2, "bogus": 3}
+	if rank[b] > rank[a] {
+		return b
+	}
+	return a
+}
+
+// denial checks the NSEC/NSEC3 records of a negative answer: their
+// signatures must verify and together they must prove that qtype does not
+// exist at name (see denies)
+func (v *dnssecValidator) denial(resp *dns.Msg, name string, qtype uint16, zone string, keys []*dns.DNSKEY) (bool, []dnssecSig, []string) {
+	var problems []string
+	verified, sigs := v.denialRecords(resp, zone, keys)
+	proof := denies(verified, name, qtype, zone)
+	if len(sigs) == 0 {
+		problems = append(problems, "negative answer without NSEC/NSEC3 records")
+	} else if !proof {
+		problems = append(problems, "NSEC/NSEC3 records do not prove the absence of "+name+" "+dns.Type(qtype).String())
+	}
+	return proof, sigs, problems
+}
+
+// denialRecords verifies the NSEC/NSEC3 RRsets in the authority section of
+// resp and returns the records of those that validate
+func (v *dnssecValidator) denialRecords(resp *dns.Msg, zone string, keys []*dns.DNSKEY) ([]dns.RR, []dnssecSig) {
+	var sigs []dnssecSig
+	var verified []dns.RR
+	for _, key := range rrsetKeys(resp.Ns) {
+		if key.rrtype != dns.TypeNSEC && key.rrtype != dns.TypeNSEC3 {
+			continue
+		}
+		rrset, rrsigs := rrsetOf(resp.Ns, key.name, key.rrtype)
+		s, ok := v.verify(rrset, rrsigs, zone, keys, dns.Type(key.rrtype).String())
+		sigs = append(sigs, s...)
+		if ok {
+			verified = append(verified, rrset...)
+		}
+	}
+	return verified, sigs
+}
+
+// wildcardLabels reports whether an RRset at owner was synthesized from a
+// wildcard: its RRSIG counts fewer labels than the owner name (a leading
+// "*" label is never counted) and the labels field gives the wildcard's
+// parent
+func wildcardLabels(owner string, sigs []*dns.RRSIG) (int, bool) {
+	n := dns.CountLabel(owner)
+	if strings.HasPrefix(owner, "*.") {
+		n--
+	}
+	for _, sig := range sigs {
+		if int(sig.Labels) < n {
+			return int(sig.Labels), true
+		}
+	}
+	return 0, false
+}
+
+// provesExpansion reports whether the NSEC/NSEC3 records show that name,
+// answered from the wildcard below its ancestor of the given label count,
+// does not exist itself: an NSEC covering name or an NSEC3 covering the
+// next closer name (RFC 4035 5.3.4, RFC 5155 8.8)
+func provesExpansion(rrs []dns.RR, name string, labels int) bool {
+	name = dns.CanonicalName(name)
+	nextCloser := ancestor(name, labels+1)
+	for _, rr := range rrs {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			if nsecCovers(dns.CanonicalName(rr.Hdr.Name), dns.CanonicalName(rr.NextDomain), name) {
+				return true
+			}
+		case *dns.NSEC3:
+			if nsec3Covers(rr, nextCloser) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// denies reports whether the NSEC/NSEC3 records of a negative answer prove
+// that qtype does not exist at name in zone: either a record matching name
+// without the type (NODATA), or a record covering name together with the
+// denial of the wildcard at its closest encloser (NXDOMAIN, RFC 4035 5.4
+// and RFC 5155 8.4-8.7)
+func denies(rrs []dns.RR, name string, qtype uint16, zone string) bool {
+	name, zone = dns.CanonicalName(name), dns.CanonicalName(zone)
+	var nsec []*dns.NSEC
+	var nsec3 []*dns.NSEC3
+	for _, rr := range rrs {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			nsec = append(nsec, rr)
+		case *dns.NSEC3:
+			nsec3 = append(nsec3, rr)
+		}
+	}
+	if len(nsec3) > 0 {
+		return nsec3Denies(nsec3, name, qtype, zone)
+	}
+	return nsecDenies(nsec, name, qtype)
+}
+
+// nsecDenies is denies for NSEC. The closest encloser of a covered name is
+// the longer of its common ancestors with the owner and the next name.
+func nsecDenies(nsec []*dns.NSEC, name string, qtype uint16) bool {
+	for _, rr := range nsec {
+		if dns.CanonicalName(rr.Hdr.Name) == name {
+			return lacksType(rr.TypeBitMap, qtype)
+		}
+	}
+	for _, rr := range nsec {
+		owner, next := dns.CanonicalName(rr.Hdr.Name), dns.CanonicalName(rr.NextDomain)
+		if !nsecCovers(owner, next, name) {
+			continue
+		}
+		// a next name below name makes it an empty non-terminal: NODATA
+		if dns.IsSubDomain(name, next) {
+			return true
+		}
+		ce := ancestor(name, max(dns.CompareDomainName(name, owner), dns.CompareDomainName(name, next)))
+		wildcard := "*." + strings.TrimPrefix(ce, ".")
+		for _, w := range nsec {
+			wOwner, wNext := dns.CanonicalName(w.Hdr.Name), dns.CanonicalName(w.NextDomain)
+			if nsecCovers(wOwner, wNext, wildcard) || (wOwner == wildcard && lacksType(w.TypeBitMap, qtype)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// nsec3Denies is denies for NSEC3: the closest encloser is the longest
+// ancestor of name with a matching record, the next closer name below it
+// must be covered and so must the wildcard at it. For DS an opt-out span
+// covering the next closer name proves an unsigned delegation.
+func nsec3Denies(nsec3 []*dns.NSEC3, name string, qtype uint16, zone string) bool {
+	for _, rr := range nsec3 {
+		if rr.Match(name) {
+			return lacksType(rr.TypeBitMap, qtype)
+		}
+	}
+	labels := dns.CountLabel(name)
+	for n := 1; labels-n >= dns.CountLabel(zone); n++ {
+		ce, nextCloser := ancestor(name, labels-n), ancestor(name, labels-n+1)
+		if !nsec3Any(nsec3, func(rr *dns.NSEC3) bool { return rr.Match(ce) }) {
+			continue
+		}
+		covered := false
+		for _, rr := range nsec3 {
+			if nsec3Covers(rr, nextCloser) {
+				if qtype == dns.TypeDS && rr.Flags&1 == 1 {
+					return true
+				}
+				covered = true
+			}
+		}
+		if !covered {
+			return false
+		}
+		wildcard := "*." + strings.TrimPrefix(ce, ".")
+		return nsec3Any(nsec3, func(rr *dns.NSEC3) bool {
+			return nsec3Covers(rr, wildcard) || (rr.Match(wildcard) && lacksType(rr.TypeBitMap, qtype))
+		})
+	}
+	return false
+}
+
+// nsec3Any reports whether one of the records satisfies f
+func nsec3Any(nsec3 []*dns.NSEC3, f func(*dns.NSEC3) bool) bool {
+	for _, rr := range nsec3 {
+		if f(rr) {
+			return true
+		}
+	}
+	return false
+}
+
+// nsec3Covers reports whether rr covers name strictly: miekg/dns also
+// counts a name whose hash equals the owner, which proves it exists
+func nsec3Covers(rr *dns.NSEC3, name string) bool {
+	return rr.Cover(name) && !rr.Match(name)
+}
+
+// nsecCovers reports whether name sorts between owner and next, the last
+// NSEC of a zone wrapping around to the apex
+func nsecCovers(owner, next, name string) bool {
+	return canonicalLess(owner, name) && (canonicalLess(name, next) || !canonicalLess(owner, next))
+}
+
+// lacksType reports whether a type bitmap proves the absence of t: neither
+// t nor a CNAME that would answer instead. The parent side of a delegation
+// (NS without SOA) only speaks for DS, the child's data lives below the cut.
+func lacksType(types []uint16, t uint16) bool {
+	if t != dns.TypeDS && hasType(types, dns.TypeNS) && !hasType(types, dns.TypeSOA) {
+		return false
+	}
+	return !hasType(types, t) && !hasType(types, dns.TypeCNAME)
+}
+
+// ancestor returns the last n labels of name as a name, "." for 0
+func ancestor(name string, n int) string {
+	labels := dns.SplitDomainName(name)
+	if n <= 0 {
+		return "."
+	}
+	return dns.Fqdn(strings.Join(labels[len(labels)-n:], "."))
+}
+
+// canonicalLess orders names as in RFC 4034 6.1 (labels compared right to left)
+func canonicalLess(a, b string) bool {
+	la, lb := dns.SplitDomainName(a), dns.SplitDomainName(b)
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		x, y := strings.ToLower(la[len(la)-i]), strings.ToLower(lb[len(lb)-i])
+		if x != y {
+			return x < y
+		}
+	}
+	return len(la) < len(lb)
+}
+
+// hasType reports whether a type bitmap contains t
+func hasType(types []uint16, t uint16) bool {
+	for _, x := range types {
+		if x == t {
+			return true
+		}
+	}
+	return false
+}
+
+// verify checks every RRSIG of an RRset; the RRset is valid when at least
+// one signature by zone verifies with keys and is within its validity period
+func (v *dnssecValidator) verify(rrset []dns.RR, sigs []*dns.RRSIG, zone string, keys []*dns.DNSKEY, label string) ([]dnssecSig, bool) {
+	var out []dnssecSig
+	valid := false
+	for _, sig := range sigs {
+		s := v.verifyOne(rrset, sig, zone, keys, label)
+		valid = valid || s.Valid
+		out = append(out, s)
+	}
+	if len(sigs) == 0 && len(rrset) > 0 {
+		out = append(out, dnssecSig{RRset: label, Error: "no RRSIG"})
+	}
+	return out, valid
+}
+
+// verifyOne verifies a single signature
+func (v *dnssecValidator) verifyOne(rrset []dns.RR, sig *dns.RRSIG, zone string, keys []*dns.DNSKEY, label string) dnssecSig {
+	s := dnssecSig{
+		RRset:      label,
+		KeyTag:     sig.KeyTag,
+		Signer:     sig.SignerName,
+		Algorithm:  dns.AlgorithmToString[sig.Algorithm],
+		Inception:  time.Unix(int64(sig.Inception), 0).UTC(),
+		Expiration: time.Unix(int64(sig.Expiration), 0).UTC(),
+	}
+	s.ExpiresIn = s.Expiration.Sub(v.now).Hours() / 24
+	if dns.CanonicalName(sig.SignerName) != zone {
+		s.Error = "signer is not " + zone
+		return s
+	}
+	var key *dns.DNSKEY
+	for _, k := range keys {
+		if k.KeyTag() == sig.KeyTag && k.Algorithm == sig.Algorithm {
+			key = k
+			break
+		}
+	}
+	if key == nil {
+		s.Error = fmt.Sprintf("no DNSKEY with tag %d", sig.KeyTag)
+		return s
+	}
+	if err := sig.Verify(key, rrset); err != nil {
+		s.Error = err.Error()
+		return s
+	}
+	if !sig.ValidityPeriod(v.now) {
+		if v.now.Before(s.Inception) {
+			s.Error = "signature not yet valid"
+		} else {
+			s.Error = "signature expired"
+		}
+		return s
+	}
+	s.Valid = true
+	return s
+}
+
+// expiryWarnings lists valid signatures that expire within dnssecExpiryWarning
+func (v *dnssecValidator) expiryWarnings(sigs []dnssecSig) []string {
+	var out []string
+	for _, s := range sigs {
+		if s.Valid && s.Expiration.Sub(v.now) < dnssecExpiryWarning {
+			out = append(out, fmt.Sprintf("RRSIG %s (key %d) expires in %.1f days (%s)", s.RRset, s.KeyTag, s.ExpiresIn, s.Expiration.Format(time.RFC3339)))
+		} else if s.Error == "signature expired" {
+			out = append(out, fmt.Sprintf("RRSIG %s (key %d) expired %s", s.RRset, s.KeyTag, s.Expiration.Format(time.RFC3339)))
+		}
+	}
+	return out
+}
+
+// rrsetKey identifies an RRset within a section
+type rrsetKey struct {
+	name   string
+	rrtype uint16
+}
+
+// rrsetKeys lists the RRsets of a section in order, leaving out RRSIGs
+func rrsetKeys(section []dns.RR) []rrsetKey {
+	var out []rrsetKey
+	seen := make(map[rrsetKey]bool)
+	for _, rr := range section {
+		h := rr.Header()
+		k := rrsetKey{dns.CanonicalName(h.Name), h.Rrtype}
+		if h.Rrtype == dns.TypeRRSIG || h.Rrtype == dns.TypeOPT || seen[k] {
+			continue
+		}
+		seen[k] = true
+		out = append(out, k)
+	}
+	return out
+}
+
+// rrsetOf returns the records of name/t in section and the RRSIGs covering them
+func rrsetOf(section []dns.RR, name string, t uint16) ([]dns.RR, []*dns.RRSIG) {
+	var rrset []dns.RR
+	var sigs []*dns.RRSIG
+	for _, rr := range section {
+		h := rr.Header()
+		if dns.CanonicalName(h.Name) != name {
+			continue
+		}
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			if sig.TypeCovered == t {
+				sigs = append(sigs, sig)
+			}
+		} else if h.Rrtype == t {
+			rrset = append(rrset, rr)
+		}
+	}
+	return rrset, sigs
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// nsecZone is the NSEC chain of a small signed zone: c.example. is an
+// alias, sub.example. a delegation, y.example. an empty non-terminal and
+// *.w.example. a wildcard
+var nsecZone = map[string]string{
+	"example.":     "example. 3600 IN NSEC a.example. NS SOA RRSIG NSEC DNSKEY",
+	"a.example.":   "a.example. 3600 IN NSEC c.example. A RRSIG NSEC",
+	"c.example.":   "c.example. 3600 IN NSEC sub.example. CNAME RRSIG NSEC",
+	"sub.example.": "sub.example. 3600 IN NSEC *.w.example. NS RRSIG NSEC",
+	"*.w.example.": "*.w.example. 3600 IN NSEC x.y.example. TXT RRSIG NSEC",
+	"x.y.example.": "x.y.example. 3600 IN NSEC example. A RRSIG NSEC",
+}
+
+func TestDeniesNSEC(t *testing.T) {
+	tests := []struct {
+		name    string
+		qname   string
+		qtype   uint16
+		records []string // owners of the NSEC records in the answer
+		want    bool
+	}{
+		{"nodata", "a.example.", dns.TypeAAAA, []string{"a.example."}, true},
+		{"type exists", "a.example.", dns.TypeA, []string{"a.example."}, false},
+		{"cname exists", "c.example.", dns.TypeA, []string{"c.example."}, false},
+		{"parent side of a delegation", "sub.example.", dns.TypeA, []string{"sub.example."}, false},
+		{"no ds at a delegation", "sub.example.", dns.TypeDS, []string{"sub.example."}, true},
+		{"nxdomain", "b.example.", dns.TypeA, []string{"a.example.", "example."}, true},
+		{"nxdomain without wildcard denial", "b.example.", dns.TypeA, []string{"a.example."}, false},
+		{"nxdomain after the last name", "zz.example.", dns.TypeA, []string{"x.y.example.", "example."}, true},
+		{"empty non-terminal", "y.example.", dns.TypeA, []string{"*.w.example."}, true},
+		{"wildcard nodata", "q.w.example.", dns.TypeA, []string{"*.w.example."}, true},
+		{"wildcard has the type", "q.w.example.", dns.TypeTXT, []string{"*.w.example."}, false},
+		{"unrelated record", "b.example.", dns.TypeA, []string{"x.y.example."}, false},
+		{"no records", "a.example.", dns.TypeAAAA, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var rrs []dns.RR
+			for _, owner := range tt.records {
+				rr, err := dns.NewRR(nsecZone[owner])
+				if err != nil {
+					t.Fatal(err)
+				}
+				rrs = append(rrs, rr)
+			}
+			if got := denies(rrs, tt.qname, tt.qtype, "example."); got != tt.want {
+				t.Errorf("denies(%s %s) = %v, want %v", tt.qname, dns.TypeToString[tt.qtype], got, tt.want)
+			}
+		})
+	}
+}
+
+// nsec3Record returns an NSEC3 record of example. (SHA-1, 1 iteration,
+// salt AB) from owner to next hash
+func nsec3Record(owner, next string, optOut bool, types ...uint16) *dns.NSEC3 {
+	var flags uint8
+	if optOut {
+		flags = 1
+	}
+	return &dns.NSEC3{
+		Hdr:  dns.RR_Header{Name: owner + ".example.", Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 3600},
+		Hash: dns.SHA1, Flags: flags, Iterations: 1, SaltLength: 1, Salt: "AB",
+		HashLength: 20, NextDomain: next, TypeBitMap: types,
+	}
+}
+
+// nsec3Hash hashes name with the parameters of nsec3Record
+func nsec3Hash(name string) string {
+	return dns.HashName(name, dns.SHA1, 1, "AB")
+}
+
+// nsec3Cover returns a record whose narrow span covers only name's hash
+func nsec3Cover(name string, optOut bool) *dns.NSEC3 {
+	h := nsec3Hash(name)
+	return nsec3Record(h[:len(h)-2]+"00", h[:len(h)-2]+"VV", optOut)
+}
+
+func TestDeniesNSEC3(t *testing.T) {
+	apex := []uint16{dns.TypeNS, dns.TypeSOA, dns.TypeRRSIG, dns.TypeDNSKEY, dns.TypeNSEC3PARAM}
+	match := func(name string, types ...uint16) *dns.NSEC3 {
+		h := nsec3Hash(name)
+		return nsec3Record(h, h[:len(h)-2]+"VV", false, types...)
+	}
+	tests := []struct {
+		name    string
+		qname   string
+		qtype   uint16
+		records []*dns.NSEC3
+		want    bool
+	}{
+		{"nodata", "a.example.", dns.TypeAAAA, []*dns.NSEC3{match("a.example.", dns.TypeA)}, true},
+		{"type exists", "a.example.", dns.TypeA, []*dns.NSEC3{match("a.example.", dns.TypeA)}, false},
+		{"parent side of a delegation", "sub.example.", dns.TypeA, []*dns.NSEC3{match("sub.example.", dns.TypeNS)}, false},
+		{"no ds at a delegation", "sub.example.", dns.TypeDS, []*dns.NSEC3{match("sub.example.", dns.TypeNS)}, true},
+		{
+			"closest encloser proof", "b.example.", dns.TypeA,
+			[]*dns.NSEC3{match("example.", apex...), nsec3Cover("b.example.", false), nsec3Cover("*.example.", false)}, true,
+		},
+		{
+			"next closer below a missing name", "x.b.example.", dns.TypeA,
+			[]*dns.NSEC3{match("example.", apex...), nsec3Cover("b.example.", false), nsec3Cover("*.example.", false)}, true,
+		},
+		{
+			"closest encloser below the apex", "x.a.example.", dns.TypeA,
+			[]*dns.NSEC3{match("a.example.", dns.TypeA), nsec3Cover("x.a.example.", false), nsec3Cover("*.a.example.", false)}, true,
+		},
+		{
+			"wildcard nodata", "b.example.", dns.TypeA,
+			[]*dns.NSEC3{match("example.", apex...), nsec3Cover("b.example.", false), match("*.example.", dns.TypeTXT)}, true,
+		},
+		{
+			"wildcard has the type", "b.example.", dns.TypeTXT,
+			[]*dns.NSEC3{match("example.", apex...), nsec3Cover("b.example.", false), match("*.example.", dns.TypeTXT)}, false,
+		},
+		{
+			"no wildcard denial", "b.example.", dns.TypeA,
+			[]*dns.NSEC3{match("example.", apex...), nsec3Cover("b.example.", false)}, false,
+		},
+		{
+			"no closest encloser", "b.example.", dns.TypeA,
+			[]*dns.NSEC3{nsec3Cover("b.example.", false), nsec3Cover("*.example.", false)}, false,
+		},
+		{
+			"next closer not covered", "x.b.example.", dns.TypeA,
+			[]*dns.NSEC3{match("example.", apex...), nsec3Cover("x.b.example.", false), nsec3Cover("*.example.", false)}, false,
+		},
+		{
+			"opt-out span for ds", "q.example.", dns.TypeDS,
+			[]*dns.NSEC3{match("example.", apex...), nsec3Cover("q.example.", true)}, true,
+		},
+		{
+			"opt-out only speaks for ds", "q.example.", dns.TypeA,
+			[]*dns.NSEC3{match("example.", apex...), nsec3Cover("q.example.", true)}, false,
+		},
+		{
+			"ds without opt-out needs the wildcard", "q.example.", dns.TypeDS,
+			[]*dns.NSEC3{match("example.", apex...), nsec3Cover("q.example.", false)}, false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rrs := make([]dns.RR, len(tt.records))
+			for i, rr := range tt.records {
+				rrs[i] = rr
+			}
+			if got := denies(rrs, tt.qname, tt.qtype, "example."); got != tt.want {
+				t.Errorf("denies(%s %s) = %v, want %v", tt.qname, dns.TypeToString[tt.qtype], got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWildcardExpansion(t *testing.T) {
+	tests := []struct {
+		name    string
+		owner   string
+		labels  uint8 // of the RRSIG
+		records []dns.RR
+		expand  bool // answer synthesized from a wildcard
+		want    bool // and the expansion is proven
+	}{
+		{name: "not expanded", owner: "a.example.", labels: 2},
+		{name: "literal wildcard name", owner: "*.example.", labels: 1},
+		{
+			name: "nsec covers the name", owner: "b.example.", labels: 1, expand: true, want: true,
+			records: []dns.RR{mustRR(t, nsecZone["a.example."])},
+		},
+		{
+			name: "nsec does not cover the name", owner: "b.example.", labels: 1, expand: true,
+			records: []dns.RR{mustRR(t, nsecZone["x.y.example."])},
+		},
+		{name: "no proof", owner: "b.example.", labels: 1, expand: true},
+		{
+			name: "nsec3 covers the next closer name", owner: "x.b.example.", labels: 1, expand: true, want: true,
+			records: []dns.RR{nsec3Cover("b.example.", false)},
+		},
+		{
+			name: "nsec3 covers the wrong name", owner: "x.b.example.", labels: 1, expand: true,
+			records: []dns.RR{nsec3Cover("x.b.example.", false)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sig := &dns.RRSIG{Labels: tt.labels}
+			labels, expanded := wildcardLabels(tt.owner, []*dns.RRSIG{sig})
+			if expanded != tt.expand {
+				t.Fatalf("wildcardLabels(%s, %d) expanded = %v, want %v", tt.owner, tt.labels, expanded, tt.expand)
+			}
+			if !expanded {
+				return
+			}
+			if got := provesExpansion(tt.records, tt.owner, labels); got != tt.want {
+				t.Errorf("provesExpansion(%s) = %v, want %v", tt.owner, got, tt.want)
+			}
+		})
+	}
+}
+
+func mustRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	traceQueryTimeout = 3 * time.Second
+	traceMaxSteps     = 16 // delegations followed before giving up
+)
+
+// rootHints is the IANA root zone NS set (named.root)
+var rootHints = []traceNS{
+	{Name: "a.root-servers.net.", Glue: []string{"198.41.0.4", "2001:503:ba3e::2:30"}},
+	{Name: "b.root-servers.net.", Glue: []string{"170.247.170.2", "2801:1b8:10::b"}},
+	{Name: "c.root-servers.net.", Glue: []string{"192.33.4.12", "2001:500:2::c"}},
+	{Name: "d.root-servers.net.", Glue: []string{"199.7.91.13", "2001:500:2d::d"}},
+	{Name: "e.root-servers.net.", Glue: []string{"192.203.230.10", "2001:500:a8::e"}},
+	{Name: "f.root-servers.net.", Glue: []string{"192.5.5.241", "2001:500:2f::f"}},
+	{Name: "g.root-servers.net.", Glue: []string{"192.112.36.4", "2001:500:12::d0d"}},
+	{Name: "h.root-servers.net.", Glue: []string{"198.97.190.53", "2001:500:1::53"}},
+	{Name: "i.root-servers.net.", Glue: []string{"192.36.148.17", "2001:7fe::53"}},
+	{Name: "j.root-servers.net.", Glue: []string{"192.58.128.30", "2001:503:c27::2:30"}},
+	{Name: "k.root-servers.net.", Glue: []string{"193.0.14.129", "2001:7fd::1"}},
+	{Name: "l.root-servers.net.", Glue: []string{"199.7.83.42", "2001:500:9f::42"}},
+	{Name: "m.root-servers.net.", Glue: []string{"202.12.27.33", "2001:dc3::35"}},
+}
+
+// traceNS is one nameserver of a zone as delegated by its parent. Resolved
+// is filled via the resolver when the referral carried no glue.
+type traceNS struct {
+	Name     string   `json:"name"`
+	Glue     []string `json:"glue"`
+	Resolved []string `json:"resolved,omitempty"`
+}
+
+// traceServer is the response of one nameserver within a step
+type traceServer struct {
+	Name     string      `json:"name"`
+	Address  string      `json:"address"`
+	RTT      float64     `json:"rtt"` // ms
+	Rcode    string      `json:"rcode,omitempty"`
+	AA       bool        `json:"aa"`
+	Status   string      `json:"status"` // referral, answer, nxdomain, nodata, lame or error
+	Referral string      `json:"referral,omitempty"`
+	NS       []string    `json:"ns,omitempty"` // NS set of the referral
+	Answer   []dnsRecord `json:"answer,omitempty"`
+	Error    string      `json:"error,omitempty"`
+
+	msg   *dns.Msg
+	rdata []string // answer in presentation format
+	sig   string   // compared between servers to spot inconsistencies
+}
+
+// traceStep is one zone of the delegation chain
+type traceStep struct {
+	Step        int           `json:"step"`
+	Zone        string        `json:"zone"`
+	Nameservers []traceNS     `json:"nameservers"`
+	Servers     []traceServer `json:"servers"`
+	Next        string        `json:"next,omitempty"` // zone delegated to
+	Problems    []string      `json:"problems,omitempty"`
+}
+
+// traceDNS handles /api/dns?trace=true: it resolves name iteratively from
+// the root, like dig +trace, and streams one "step" event per zone followed
+// by a "summary". The server parameter is not part of the chain: it primes
+// the root NS set (unless "system") and resolves nameservers without glue.
+func traceDNS(w http.ResponseWriter, r *http.Request, name, typ, override string) {
+	lookupName, err := queryName(name, typ)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	qtype, err := parseQueryType(typ)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resolver, err := parseUpstream(chooseServer(override))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	flusher, ok := startSSE(w)
+	if !ok {
+		return
+	}
+
+	ctx := r.Context()
+	qname := dns.Fqdn(lookupName)
+	summary := map[string]interface{}{"name": qname, "type": dns.Type(qtype).String()}
+	start := time.Now()
+
+	zone, servers := ".", rootHints
+	if override != "" && override != "system" {
+		servers, err = primeRoots(ctx, resolver)
+		if err != nil {
+			summary["error"] = "priming root servers via " + override + ": " + err.Error()
+			data, _ := json.Marshal(summary)
+			fmt.Fprintf(w, "event: summary\ndata: %s\n\n", data)
+			flusher.Flush()
+			return
+		}
+	}
+
+	result := "failed"
+	var answer []dnsRecord
+	steps := 0
+	for steps < traceMaxSteps {
+		steps++
+		step := traceStep{Step: steps, Zone: zone, Nameservers: servers}
+		best := traceZone(ctx, &step, qname, qtype)
+		if ctx.Err() != nil {
+			return
+		}
+
+		var next []traceNS
+		switch {
+		case best == nil:
+			step.Problems = append(step.Problems, "no usable response from any nameserver of "+zone)
+		case best.Status == "referral":
+			step.Next = best.Referral
+			next = referralServers(ctx, resolver, best.msg, best.Referral)
+			if len(next) == 0 {
+				step.Problems = append(step.Problems, "referral to "+best.Referral+" without nameservers")
+			}
+		default:
+			result, answer = best.Status, best.Answer
+		}
+
+		data, _ := json.Marshal(step)
+		fmt.Fprintf(w, "event: step\ndata: %s\n\n", data)
+		flusher.Flush()
+		if next == nil {
+			break
+		}
+		zone, servers = step.Next, next
+	}
+	if result == "failed" && steps == traceMaxSteps {
+		summary["error"] = fmt.Sprintf("gave up after %d delegations", traceMaxSteps)
+	}
+
+	summary["steps"] = steps
+	summary["result"] = result
+	summary["answer"] = answer
+	summary["time"] = float64(time.Since(start)) / float64(time.Millisecond)
+	data, _ := json.Marshal(summary)
+	fmt.Fprintf(w, "event: summary\ndata: %s\n\n", data)
+	flusher.Flush()
+}
+
+// traceZone queries every nameserver of step.Zone in parallel, records
+// lame and diverging servers as problems and returns the majority response
+// (nil if no server gave a usable one)
+func traceZone(ctx context.Context, step *traceStep, qname string, qtype uint16) *traceServer {
+	step.Servers = make([]traceServer, len(step.Nameservers))
+	var wg sync.WaitGroup
+	for i, ns := range step.Nameservers {
+		step.Servers[i] = traceServer{Name: ns.Name, Status: "error"}
+		addr := traceAddress(ns)
+		if addr == "" {
+			step.Servers[i].Error = "no address"
+			continue
+		}
+		step.Servers[i].Address = addr
+		wg.Add(1)
+		go func(s *traceServer) {
+			defer wg.Done()
+			queryTraceServer(ctx, s, step.Zone, qname, qtype)
+		}(&step.Servers[i])
+	}
+	wg.Wait()
+
+	// majority by signature, first occurrence wins ties
+	count := make(map[string]int)
+	var best *traceServer
+	for i := range step.Servers {
+		s := &step.Servers[i]
+		switch s.Status {
+		case "error":
+			step.Problems = append(step.Problems, fmt.Sprintf("%s (%s): %s", s.Name, s.Address, s.Error))
+			continue
+		case "lame":
+			step.Problems = append(step.Problems, fmt.Sprintf("%s (%s) is lame for %s: %s", s.Name, s.Address, step.Zone, s.Error))
+			continue
+		}
+		count[s.sig]++
+		if best == nil || count[s.sig] > count[best.sig] {
+			best = s
+		}
+	}
+	if len(count) > 1 {
+		for _, s := range step.Servers {
+			if s.sig != "" && s.sig != best.sig {
+				step.Problems = append(step.Problems, fmt.Sprintf("%s (%s) is inconsistent: %s", s.Name, s.Address, s.describe()))
+			}
+		}
+	}
+	return best
+}
+
+// queryTraceServer sends the non-recursive query and classifies the answer
+func queryTraceServer(ctx context.Context, s *traceServer, zone, qname string, qtype uint16) {
+	resp, rtt, err := queryAuthoritative(ctx, s.Address, qname, qtype)
+	s.RTT = float64(rtt) / float64(time.Millisecond)
+	if err != nil {
+		s.Error = err.Error()
+		return
+	}
+	s.msg, s.Rcode, s.AA = resp, dns.RcodeToString[resp.Rcode], resp.Authoritative
+
+	switch resp.Rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+	default:
+		s.Status, s.Error = "lame", "answered "+s.Rcode
+		return
+	}
+	if len(resp.Answer) > 0 {
+		s.Status, s.Answer = "answer", sectionRecords(resp.Answer)
+		for _, rr := range resp.Answer {
+			s.rdata = append(s.rdata, dns.Type(rr.Header().Rrtype).String()+" "+rdataString(rr))
+		}
+		sort.Strings(s.rdata)
+		s.sig = "answer " + strings.ToLower(strings.Join(s.rdata, " "))
+		return
+	}
+	if resp.Rcode == dns.RcodeNameError {
+		s.Status, s.sig = "nxdomain", "nxdomain"
+		return
+	}
+
+	var ns []string
+	for _, rr := range resp.Ns {
+		if rr, ok := rr.(*dns.NS); ok {
+			if s.Referral == "" {
+				s.Referral = dns.CanonicalName(rr.Header().Name)
+			}
+			ns = append(ns, dns.CanonicalName(rr.Ns))
+		}
+	}
+	if s.Referral == "" || resp.Authoritative {
+		if resp.Authoritative {
+			s.Status, s.sig, s.Referral = "nodata", "nodata", ""
+		} else {
+			s.Status, s.Error = "lame", "neither authoritative nor a referral"
+		}
+		return
+	}
+	// a referral must lead further down towards qname
+	if s.Referral == dns.CanonicalName(zone) || !dns.IsSubDomain(zone, s.Referral) || !dns.IsSubDomain(s.Referral, qname) {
+		s.Status, s.Error = "lame", "referral to "+s.Referral+" does not lead towards "+qname
+		return
+	}
+	sort.Strings(ns)
+	s.Status, s.NS = "referral", ns
+	s.sig = "referral " + s.Referral + " " + strings.Join(ns, " ")
+}
+
+// queryAuthoritative sends a non-recursive query to a nameserver address,
+// retrying over TCP when the UDP answer is truncated
+func queryAuthoritative(ctx context.Context, addr, qname string, qtype uint16) (*dns.Msg, time.Duration, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(qname, qtype)
+	msg.RecursionDesired = false
+	msg.SetEdns0(defaultEDNSBufSize, false)
+
+	ctx, cancel := context.WithTimeout(ctx, traceQueryTimeout)
+	defer cancel()
+	up := &dnsUpstream{Proto: "udp", Addr: net.JoinHostPort(addr, "53")}
+	resp, rtt, err := up.exchange(ctx, msg)
+	if err == nil && resp.Truncated {
+		up.Proto = "tcp"
+		resp, rtt, err = up.exchange(ctx, msg)
+	}
+	return resp, rtt, err
+}
+
+// describe summarises a response for problem messages
+func (s traceServer) describe() string {
+	switch s.Status {
+	case "referral":
+		return "referral to " + s.Referral + " (" + strings.Join(s.NS, ", ") + ")"
+	case "answer":
+		return "answer " + strings.Join(s.rdata, ", ")
+	}
+	return s.Status
+}
+
+// referralServers collects the NS set of a referral together with the glue
+// from the additional section; nameservers without glue are looked up via
+// resolver
+func referralServers(ctx context.Context, resolver *dnsUpstream, msg *dns.Msg, zone string) []traceNS {
+	glue := make(map[string][]string)
+	for _, rr := range msg.Extra {
+		switch rr := rr.(type) {
+		case *dns.A:
+			n := dns.CanonicalName(rr.Hdr.Name)
+			glue[n] = append(glue[n], rr.A.String())
+		case *dns.AAAA:
+			n := dns.CanonicalName(rr.Hdr.Name)
+			glue[n] = append(glue[n], rr.AAAA.String())
+		}
+	}
+	var out []traceNS
+	seen := make(map[string]bool)
+	for _, rr := range msg.Ns {
+		rr, ok := rr.(*dns.NS)
+		if !ok || dns.CanonicalName(rr.Hdr.Name) != zone {
+			continue
+		}
+		name := dns.CanonicalName(rr.Ns)
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		ns := traceNS{Name: name, Glue: glue[name]}
+		if ns.Glue == nil {
+			ns.Glue = []string{}
+			ns.Resolved = resolveNS(ctx, resolver, name, dns.TypeA, dns.TypeAAAA)
+		}
+		out = append(out, ns)
+	}
+	return out
+}
+
+// resolveNS looks up the addresses of a nameserver of the given types
+func resolveNS(ctx context.Context, resolver *dnsUpstream, name string, qtypes ...uint16) []string {
+	if len(qtypes) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, dnsTimeout)
+	defer cancel()
+	var addrs []string
+	for _, qtype := range qtypes {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, qtype)
+		resp, _, err := resolver.exchange(ctx, msg)
+		if err != nil {
+			continue
+		}
+		for _, rr := range resp.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				addrs = append(addrs, rr.A.String())
+			case *dns.AAAA:
+				addrs = append(addrs, rr.AAAA.String())
+			}
+		}
+	}
+	return addrs
+}
+
+// primeRoots asks up for the root NS set (". NS") and its glue
+func primeRoots(ctx context.Context, up *dnsUpstream) ([]traceNS, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(".", dns.TypeNS)
+	msg.SetEdns0(defaultEDNSBufSize, false)
+	ctx, cancel := context.WithTimeout(ctx, dnsTimeout)
+	defer cancel()
+	resp, _, err := up.exchange(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
+	// treat the answer like a referral to the root
+	resp.Ns = resp.Answer
+	servers := referralServers(ctx, up, resp, ".")
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no root NS records (%s)", dns.RcodeToString[resp.Rcode])
+	}
+	return servers, nil
+}
+
+// traceAddress picks the address to query, IPv4 preferred
+func traceAddress(ns traceNS) string {
+	addrs := append(append([]string{}, ns.Glue...), ns.Resolved...)
+	for _, a := range addrs {
+		if ip := net.ParseIP(a); ip != nil && ip.To4() != nil {
+			return a
+		}
+	}
+	if len(addrs) > 0 {
+		return addrs[0]
+	}
+	return ""
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/quic"
+)
+
+const upstreamMaxCA = 1 << 20 // bytes read from a ca bundle
+
+// upstreamCAFiles are the servers whose ca option may name a file on the
+// noc2go host: those in noc2go.yaml or given with --dns-server at startup,
+// and those an admin added in the settings. Everyone else has to pass the
+// PEM inline.
+var (
+	upstreamCAFiles = map[string]bool{}
+	upstreamCAMutex sync.RWMutex
+)
+
+// dnsDefaultPorts are used when a resolver URL has no port
+var dnsDefaultPorts = map[string]string{
+	"udp":   "53",
+	"tls":   "853",
+	"https": "443",
+	"quic":  "853",
+}
+
+// dnsUpstream is a parsed resolver address. Plain "host[:port]" means
+// classic DNS; tls://, https:// and quic:// select DoT, DoH and DoQ. The
+// query parameters sni, bootstrap, insecure and ca (inline PEM, or a file
+// for the servers in upstreamCAFiles) tune the encrypted transports and are
+// not sent to the server.
+type dnsUpstream struct {
+	Proto string // udp, tcp, tls, https or quic
+	Addr  string // host:port actually dialled (bootstrap IP applied)
+	URL   string // DoH endpoint without our options
+	TLS   *tls.Config
+}
+
+// parseUpstream parses a server string as stored in Config.DNS.CustomServers
+func parseUpstream(server string) (*dnsUpstream, error) {
+	upstreamCAMutex.RLock()
+	caFile := upstreamCAFiles[server]
+	upstreamCAMutex.RUnlock()
+	return newUpstream(server, caFile)
+}
+
+// newUpstream is parseUpstream with the ca option read from a file when
+// caFile is set
+func newUpstream(server string, caFile bool) (*dnsUpstream, error) {
+	if !strings.Contains(server, "://") {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		return &dnsUpstream{Proto: "udp", Addr: server}, nil
+	}
+
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, fmt.Errorf("invalid resolver URL: %v", err)
+	}
+	defPort, ok := dnsDefaultPorts[u.Scheme]
+	if !ok || u.Scheme == "udp" {
+		return nil, fmt.Errorf("unsupported resolver scheme %q (tls, https or quic)", u.Scheme)
+	}
+	host := u.Hostname()
+	if host == "" {
+		return nil, errors.New("resolver URL without host")
+	}
+	port := u.Port()
+	if port == "" {
+		port = defPort
+	}
+
+	q := u.Query()
+	cfg := &tls.Config{ServerName: host, InsecureSkipVerify: q.Get("insecure") == "true"}
+	if sni := q.Get("sni"); sni != "" {
+		cfg.ServerName = sni
+	}
+	if ca := q.Get("ca"); ca != "" {
+		pem, err := readUpstreamCA(ca, caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("ca contains no PEM certificates")
+		}
+	}
+	dialHost := host
+	if b := q.Get("bootstrap"); b != "" {
+		if net.ParseIP(b) == nil {
+			return nil, errors.New("bootstrap must be an IP address")
+		}
+		dialHost = b
+	}
+
+	up := &dnsUpstream{Proto: u.Scheme, Addr: net.JoinHostPort(dialHost, port), TLS: cfg}
+	switch u.Scheme {
+	case "tls":
+		cfg.NextProtos = []string{"dot"}
+	case "quic":
+		cfg.NextProtos = []string{"doq"}
+		cfg.MinVersion = tls.VersionTLS13
+	case "https":
+		for _, k := range []string{"sni", "bootstrap", "insecure", "ca"} {
+			q.Del(k)
+		}
+		u.RawQuery = q.Encode()
+		if u.Path == "" {
+			u.Path = "/dns-query"
+		}
+		up.URL = u.String()
+	}
+	return up, nil
+}
+
+// allowUpstreamCAFile lets server read the file named by its ca option
+func allowUpstreamCAFile(server string) {
+	upstreamCAMutex.Lock()
+	defer upstreamCAMutex.Unlock()
+	upstreamCAFiles[server] = true
+}
+
+// revokeUpstreamCAFile undoes allowUpstreamCAFile for a removed server
+func revokeUpstreamCAFile(server string) {
+	upstreamCAMutex.Lock()
+	defer upstreamCAMutex.Unlock()
+	delete(upstreamCAFiles, server)
+}
+
+// upstreamCAIsFile reports whether the ca option of a resolver URL names a
+// file rather than carrying the PEM inline
+func upstreamCAIsFile(server string) bool {
+	u, err := url.Parse(server)
+	if err != nil {
+		return false
+	}
+	ca := u.Query().Get("ca")
+	return ca != "" && !isInlinePEM(ca)
+}
+
+// isInlinePEM tells an inline PEM bundle from a file name
+func isInlinePEM(ca string) bool {
+	return strings.HasPrefix(strings.TrimSpace(ca), "-----BEGIN")
+}
+
+// readUpstreamCA returns the inline PEM of the ca option or, when caFile
+// is set, the content of the file it names
+func readUpstreamCA(ca string, caFile bool) ([]byte, error) {
+	if isInlinePEM(ca) {
+		return []byte(ca), nil
+	}
+	if !caFile {
+		return nil, errors.New("ca must be inline PEM; files are only read for servers configured by an admin")
+	}
+	f, err := os.Open(ca)
+	if err != nil {
+		return nil, fmt.Errorf("reading ca: %v", err)
+	}
+	defer f.Close()
+	pem, err := io.ReadAll(io.LimitReader(f, upstreamMaxCA))
+	if err != nil {
+		return nil, fmt.Errorf("reading ca: %v", err)
+	}
+	return pem, nil
+}
+
+// exchange sends msg and returns the answer and the round-trip time
+func (up *dnsUpstream) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	switch up.Proto {
+	case "tls":
+		client := &dns.Client{Net: "tcp-tls", Timeout: dnsTimeout, TLSConfig: up.TLS}
+		return client.ExchangeContext(ctx, msg, up.Addr)
+	case "https":
+		return up.exchangeHTTPS(ctx, msg)
+	case "quic":
+		return up.exchangeQUIC(ctx, msg)
+	case "tcp":
+		client := &dns.Client{Net: "tcp", Timeout: dnsTimeout}
+		return client.ExchangeContext(ctx, msg, up.Addr)
+	}
+	client := &dns.Client{Timeout: dnsTimeout}
+	return client.ExchangeContext(ctx, msg, up.Addr)
+}
+
+// exchangeHTTPS implements RFC 8484 (POST, application/dns-message)
+func (up *dnsUpstream) exchangeHTTPS(ctx context.Context, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	// ID 0 keeps DoH answers cacheable
+	q := msg.Copy()
+	q.Id = 0
+	wire, err := q.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	dialer := &net.Dialer{Timeout: dnsTimeout}
+	client := &http.Client{
+		Timeout: dnsTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, up.Addr)
+			},
+			TLSClientConfig:   up.TLS,
+			ForceAttemptHTTP2: true,
+		},
+	}
+	defer client.CloseIdleConnections()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, up.URL, bytes.NewReader(wire))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	rtt := time.Since(start)
+	if err != nil {
+		return nil, rtt, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, rtt, fmt.Errorf("DoH server returned %s", resp.Status)
+	}
+	out := new(dns.Msg)
+	if err := out.Unpack(body); err != nil {
+		return nil, rtt, err
+	}
+	out.Id = msg.Id
+	return out, rtt, nil
+}
+
+// exchangeQUIC implements RFC 9250: one query per bidirectional stream,
+// each message prefixed with its 2-byte length
+func (up *dnsUpstream) exchangeQUIC(ctx context.Context, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	q := msg.Copy()
+	q.Id = 0
+	wire, err := q.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, dnsTimeout)
+	defer cancel()
+	ep, err := quic.Listen("udp", ":0", nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func() {
+		go func() {
+			closeCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			ep.Close(closeCtx)
+		}()
+	}()
+
+	start := time.Now()
+	conn, err := ep.Dial(ctx, "udp", up.Addr, &quic.Config{TLSConfig: up.TLS})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Abort(nil)
+	stream, err := conn.NewStream(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	stream.SetReadContext(ctx)
+	stream.SetWriteContext(ctx)
+
+	frame := binary.BigEndian.AppendUint16(nil, uint16(len(wire)))
+	if _, err := stream.Write(append(frame, wire...)); err != nil {
+		return nil, 0, err
+	}
+	stream.CloseWrite()
+
+	var size [2]byte
+	if _, err := io.ReadFull(stream, size[:]); err != nil {
+		return nil, 0, err
+	}
+	body := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(stream, body); err != nil {
+		return nil, 0, err
+	}
+	rtt := time.Since(start)
+	out := new(dns.Msg)
+	if err := out.Unpack(body); err != nil {
+		return nil, rtt, err
+	}
+	out.Id = msg.Id
+	return out, rtt, nil
+}
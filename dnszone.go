@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// zoneServer is one address of one authoritative nameserver of the zone
+type zoneServer struct {
+	Name    string   `json:"name"`
+	Address string   `json:"address"`
+	Glue    bool     `json:"glue"` // address taken from the parent's glue
+	RTT     float64  `json:"rtt"`  // ms, SOA query
+	Rcode   string   `json:"rcode,omitempty"`
+	AA      bool     `json:"aa"`
+	Status  string   `json:"status"` // ok, not_authoritative, lame or error
+	Serial  uint32   `json:"serial,omitempty"`
+	NS      []string `json:"ns,omitempty"`
+	Answer  []string `json:"answer,omitempty"` // "TYPE data" of the checked record set
+	Match   bool     `json:"match"`            // answer equals the majority
+	Error   string   `json:"error,omitempty"`
+
+	set string // rcode and answer, compared between servers
+}
+
+// zoneCheck is the JSON answer of /api/dns/zonecheck
+type zoneCheck struct {
+	Zone       string       `json:"zone"`
+	Name       string       `json:"name"` // owner of the checked record set
+	Type       string       `json:"type"`
+	Parent     string       `json:"parent,omitempty"`
+	Delegation []traceNS    `json:"delegation"` // NS set and glue as sent by the parent
+	Servers    []zoneServer `json:"servers"`
+	Problems   []string     `json:"problems"`
+	Notes      []string     `json:"notes"` // informational, do not affect Healthy
+	Healthy    bool         `json:"healthy"`
+	Time       float64      `json:"time"` // ms
+}
+
+// apiDNSZoneCheckHandler handles GET /api/dns/zonecheck?zone=...&name=...&type=...&server=...:
+// the delegation of zone is followed from the root, every address (IPv4
+// and IPv6) of every nameserver is asked directly for SOA and NS at the
+// apex and for the record set type (default NS) at name (default the
+// apex), and the differences are reported as problems. The server
+// parameter primes the root NS set and resolves the addresses missing
+// from the glue.
+func apiDNSZoneCheckHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	q := r.URL.Query()
+	zone := dns.CanonicalName(dns.Fqdn(strings.TrimSpace(q.Get("zone"))))
+	if strings.TrimSpace(q.Get("zone")) == "" {
+		fmt.Fprint(w, `{"error":"zone is required"}`)
+		return
+	}
+	name := zone
+	if n := strings.TrimSpace(q.Get("name")); n != "" {
+		name = dns.CanonicalName(dns.Fqdn(n))
+	}
+	if _, ok := dns.IsDomainName(name); !ok || !dns.IsSubDomain(zone, name) {
+		fmt.Fprintf(w, `{"error":%q}`, "name must be "+zone+" or a name below it")
+		return
+	}
+	typ := strings.ToUpper(q.Get("type"))
+	if typ == "" {
+		typ = "NS"
+	}
+	qtype, err := parseQueryType(typ)
+	if err != nil {
+		fmt.Fprintf(w, `{"error":%q}`, err.Error())
+		return
+	}
+	override := q.Get("server")
+	resolver, err := parseUpstream(chooseServer(override))
+	if err != nil {
+		fmt.Fprintf(w, `{"error":%q}`, err.Error())
+		return
+	}
+
+	ctx := r.Context()
+	start := time.Now()
+	roots := rootHints
+	if override != "" && override != "system" {
+		roots, err = primeRoots(ctx, resolver)
+		if err != nil {
+			fmt.Fprintf(w, `{"error":%q}`, "priming root servers via "+override+": "+err.Error())
+			return
+		}
+	}
+	check := &zoneCheck{Zone: zone, Name: name, Type: dns.Type(qtype).String(), Problems: []string{}, Notes: []string{}}
+	check.Parent, check.Delegation, err = zoneDelegation(ctx, resolver, roots, zone)
+	if err != nil {
+		fmt.Fprintf(w, `{"error":%q}`, err.Error())
+		return
+	}
+	check.run(ctx, qtype)
+	check.Healthy = len(check.Problems) == 0
+	check.Time = float64(time.Since(start)) / float64(time.Millisecond)
+	data, _ := json.Marshal(check)
+	fmt.Fprint(w, string(data))
+}
+
+// zoneDelegation follows referrals from the root towards zone and returns
+// the parent zone and the nameservers it delegates zone to, with the
+// address families missing from the glue resolved. When the parent servers
+// also serve zone, their NS answer stands in for the referral.
+func zoneDelegation(ctx context.Context, resolver *dnsUpstream, roots []traceNS, zone string) (string, []traceNS, error) {
+	if zone == "." {
+		return "", completeGlue(ctx, resolver, roots), nil
+	}
+	cur, servers := ".", roots
+	for i := 0; i < traceMaxSteps; i++ {
+		step := traceStep{Zone: cur, Nameservers: servers}
+		best := traceZone(ctx, &step, zone, dns.TypeNS)
+		if ctx.Err() != nil {
+			return cur, nil, ctx.Err()
+		}
+		switch {
+		case best == nil:
+			return cur, nil, fmt.Errorf("no usable response from the nameservers of %s", cur)
+		case best.Status == "nxdomain":
+			return cur, nil, fmt.Errorf("%s does not exist (NXDOMAIN from %s)", zone, cur)
+		case best.Status == "answer" && nsAnswer(best.msg, zone):
+			msg := best.msg.Copy()
+			msg.Ns = msg.Answer
+			return cur, completeGlue(ctx, resolver, referralServers(ctx, resolver, msg, zone)), nil
+		case best.Status != "referral":
+			return cur, nil, fmt.Errorf("%s is not delegated, it is part of the zone %s", zone, cur)
+		}
+		next := referralServers(ctx, resolver, best.msg, best.Referral)
+		if best.Referral == zone {
+			return cur, completeGlue(ctx, resolver, next), nil
+		}
+		if len(next) == 0 {
+			return cur, nil, fmt.Errorf("referral to %s without nameservers", best.Referral)
+		}
+		cur, servers = best.Referral, next
+	}
+	return "", nil, fmt.Errorf("gave up after %d delegations", traceMaxSteps)
+}
+
+// completeGlue looks up, in parallel, the A or AAAA records of nameservers
+// whose glue covers only one address family, so that every address of the
+// zone gets checked
+func completeGlue(ctx context.Context, resolver *dnsUpstream, servers []traceNS) []traceNS {
+	out := make([]traceNS, len(servers))
+	var wg sync.WaitGroup
+	for i, ns := range servers {
+		out[i] = ns
+		if len(ns.Glue) == 0 {
+			continue // resolved by referralServers
+		}
+		var missing uint16
+		switch countIPv6(ns.Glue) {
+		case 0:
+			missing = dns.TypeAAAA
+		case len(ns.Glue):
+			missing = dns.TypeA
+		default:
+			continue
+		}
+		wg.Add(1)
+		go func(ns *traceNS) {
+			defer wg.Done()
+			ns.Resolved = resolveNS(ctx, resolver, ns.Name, missing)
+		}(&out[i])
+	}
+	wg.Wait()
+	return out
+}
+
+// nsAnswer reports whether msg answers with the NS set of zone
+func nsAnswer(msg *dns.Msg, zone string) bool {
+	for _, rr := range msg.Answer {
+		if rr.Header().Rrtype == dns.TypeNS && dns.CanonicalName(rr.Header().Name) == zone {
+			return true
+		}
+	}
+	return false
+}
+
+// hasIPv6 reports whether addrs holds an IPv6 address
+func hasIPv6(addrs []string) bool {
+	return countIPv6(addrs) > 0
+}
+
+// countIPv6 counts the IPv6 addresses in addrs
+func countIPv6(addrs []string) int {
+	n := 0
+	for _, a := range addrs {
+		if strings.Contains(a, ":") {
+			n++
+		}
+	}
+	return n
+}
+
+// run queries every nameserver address in parallel and collects the
+// problems of the delegation, the servers and their answers
+func (c *zoneCheck) run(ctx context.Context, qtype uint16) {
+	var delegated []string
+	for _, ns := range c.Delegation {
+		delegated = append(delegated, ns.Name)
+		if len(ns.Glue) == 0 && c.Parent != "" && dns.IsSubDomain(c.Zone, ns.Name) {
+			c.Problems = append(c.Problems, fmt.Sprintf("missing glue: %s is inside %s but %s sends no address for it", ns.Name, c.Zone, c.Parent))
+		}
+		if len(ns.Glue)+len(ns.Resolved) == 0 {
+			c.Problems = append(c.Problems, fmt.Sprintf("%s has no address", ns.Name))
+		} else if !hasIPv6(ns.Glue) && !hasIPv6(ns.Resolved) {
+			c.Notes = append(c.Notes, fmt.Sprintf("%s has no IPv6 address", ns.Name))
+		}
+		for _, a := range ns.Glue {
+			c.Servers = append(c.Servers, zoneServer{Name: ns.Name, Address: a, Glue: true})
+		}
+		for _, a := range ns.Resolved {
+			c.Servers = append(c.Servers, zoneServer{Name: ns.Name, Address: a})
+		}
+	}
+	sort.Strings(delegated)
+
+	var wg sync.WaitGroup
+	for i := range c.Servers {
+		wg.Add(1)
+		go func(s *zoneServer) {
+			defer wg.Done()
+			queryZoneServer(ctx, s, c.Zone, c.Name, qtype)
+		}(&c.Servers[i])
+	}
+	wg.Wait()
+
+	serials := make(map[uint32][]string)
+	nsSets := make(map[string]int)
+	answers := make(map[string]int)
+	var order []uint32
+	var best *zoneServer
+	for i := range c.Servers {
+		s := &c.Servers[i]
+		where := fmt.Sprintf("%s (%s)", s.Name, s.Address)
+		switch s.Status {
+		case "error":
+			c.Problems = append(c.Problems, fmt.Sprintf("%s does not answer: %s", where, s.Error))
+			continue
+		case "lame":
+			c.Problems = append(c.Problems, fmt.Sprintf("lame delegation: %s %s", where, s.Error))
+			continue
+		case "not_authoritative":
+			c.Problems = append(c.Problems, fmt.Sprintf("%s answers for %s without the AA bit", where, c.Zone))
+		}
+		if _, ok := serials[s.Serial]; !ok {
+			order = append(order, s.Serial)
+		}
+		serials[s.Serial] = append(serials[s.Serial], where)
+		if s.Error != "" {
+			c.Problems = append(c.Problems, fmt.Sprintf("%s: %s", where, s.Error))
+			continue
+		}
+		nsSets[strings.Join(s.NS, ", ")]++
+		answers[s.set]++
+		if best == nil || answers[s.set] > answers[best.set] {
+			best = s
+		}
+	}
+
+	if len(serials) > 1 {
+		var parts []string
+		for _, serial := range order {
+			parts = append(parts, fmt.Sprintf("%d on %s", serial, strings.Join(serials[serial], ", ")))
+		}
+		c.Problems = append(c.Problems, "SOA serial mismatch: "+strings.Join(parts, "; "))
+	}
+	from := "the delegation in " + c.Parent
+	if c.Parent == "" {
+		from = "the root hints"
+	}
+	var sets []string
+	for set := range nsSets {
+		sets = append(sets, set)
+	}
+	sort.Strings(sets)
+	for _, set := range sets {
+		if n := nsSets[set]; set != strings.Join(delegated, ", ") {
+			c.Problems = append(c.Problems, fmt.Sprintf("NS set served by %d server(s) (%s) differs from %s (%s)", n, set, from, strings.Join(delegated, ", ")))
+		}
+	}
+	if best == nil {
+		return
+	}
+	for i := range c.Servers {
+		s := &c.Servers[i]
+		if s.set == "" {
+			continue
+		}
+		s.Match = s.set == best.set
+		if !s.Match {
+			var diff []string
+			for _, k := range missingKeys(best.Answer, s.Answer) {
+				diff = append(diff, "missing "+k)
+			}
+			for _, k := range missingKeys(s.Answer, best.Answer) {
+				diff = append(diff, "extra "+k)
+			}
+			if len(diff) == 0 {
+				diff = append(diff, "different rcode")
+			}
+			c.Problems = append(c.Problems, fmt.Sprintf("%s (%s) answers %s %s differently: %s", s.Name, s.Address, c.Name, c.Type, strings.Join(diff, "; ")))
+		}
+	}
+}
+
+// queryZoneServer asks one address for the SOA and the NS set of zone and
+// for the checked record set at name
+func queryZoneServer(ctx context.Context, s *zoneServer, zone, name string, qtype uint16) {
+	resp, rtt, err := queryAuthoritative(ctx, s.Address, zone, dns.TypeSOA)
+	s.RTT = float64(rtt) / float64(time.Millisecond)
+	s.Status = "error"
+	if err != nil {
+		s.Error = err.Error()
+		return
+	}
+	s.Rcode, s.AA = dns.RcodeToString[resp.Rcode], resp.Authoritative
+	if resp.Rcode != dns.RcodeSuccess {
+		s.Status, s.Error = "lame", "answered "+s.Rcode
+		return
+	}
+	soa := false
+	for _, rr := range resp.Answer {
+		if rr, ok := rr.(*dns.SOA); ok && dns.CanonicalName(rr.Hdr.Name) == zone {
+			s.Serial, soa = rr.Serial, true
+		}
+	}
+	if !soa {
+		s.Status, s.Error = "lame", "does not serve "+zone+" (no SOA in the answer)"
+		return
+	}
+	s.Status = "ok"
+	if !resp.Authoritative {
+		s.Status = "not_authoritative"
+	}
+
+	ns, _, err := queryAuthoritative(ctx, s.Address, zone, dns.TypeNS)
+	if err != nil {
+		s.Error = "NS query: " + err.Error()
+		return
+	}
+	for _, rr := range ns.Answer {
+		if rr, ok := rr.(*dns.NS); ok {
+			s.NS = append(s.NS, dns.CanonicalName(rr.Ns))
+		}
+	}
+	sort.Strings(s.NS)
+
+	answer := resp
+	switch {
+	case name == zone && qtype == dns.TypeSOA:
+	case name == zone && qtype == dns.TypeNS:
+		answer = ns
+	default:
+		answer, _, err = queryAuthoritative(ctx, s.Address, name, qtype)
+		if err != nil {
+			s.Error = dns.Type(qtype).String() + " query: " + err.Error()
+			return
+		}
+	}
+	for _, rr := range answer.Answer {
+		s.Answer = append(s.Answer, dns.Type(rr.Header().Rrtype).String()+" "+rdataString(rr))
+	}
+	sort.Strings(s.Answer)
+	s.set = strings.ToLower(dns.RcodeToString[answer.Rcode] + "\n" + strings.Join(s.Answer, "\n"))
+}
@@ -0,0 +1,14 @@
+//go:build linux
+// +build linux
+
+package main
+
+import "syscall"
+
+// setDontFragment sets the DF bit (IPv4) or disables fragmentation (IPv6) on fd.
+func setDontFragment(fd uintptr, v6 bool) error {
+	if v6 {
+		return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IP_PMTUDISC_DO)
+	}
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DO)
+}
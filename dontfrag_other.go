@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+// setDontFragment is only implemented for Linux; elsewhere the system ping is used.
+func setDontFragment(fd uintptr, v6 bool) error {
+	return errors.New("don't-fragment not supported on this platform")
+}
@@ -8,12 +8,12 @@ require (
 	github.com/gorilla/securecookie v1.1.2
 	github.com/miekg/dns v1.1.65
 	golang.org/x/crypto v0.45.0
+	golang.org/x/net v0.47.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	golang.org/x/mod v0.24.0 // indirect
-	golang.org/x/net v0.47.0 // indirect
 	golang.org/x/sync v0.13.0 // indirect
 	golang.org/x/sys v0.38.0 // indirect
 	golang.org/x/tools v0.32.0 // indirect
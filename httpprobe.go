@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	httpTimeout      = 15 * time.Second
+	httpMaxRedirects = 10
+	httpMaxBody      = 10 << 20
+)
+
+// httpTiming holds the phases of one request in milliseconds
+type httpTiming struct {
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	TLS     float64 `json:"tls"`
+	TTFB    float64 `json:"ttfb"`
+	Total   float64 `json:"total"`
+}
+
+// httpHop is one request/response in the redirect chain
+type httpHop struct {
+	URL        string              `json:"url"`
+	Status     int                 `json:"status"`
+	StatusText string              `json:"status_text"`
+	Proto      string              `json:"proto"`
+	RemoteAddr string              `json:"remote_addr,omitempty"`
+	TLSVersion string              `json:"tls_version,omitempty"`
+	Cipher     string              `json:"cipher,omitempty"`
+	Location   string              `json:"location,omitempty"`
+	Headers    map[string][]string `json:"headers"`
+	BodyBytes  int64               `json:"body_bytes"`
+	Timing     httpTiming          `json:"timing"`
+}
+
+// httpProbeResult is the JSON answer of /api/http
+type httpProbeResult struct {
+	URL       string    `json:"url"`
+	Status    int       `json:"status"`
+	Proto     string    `json:"proto"`
+	Redirects []httpHop `json:"redirects"`
+	Final     httpHop   `json:"final"`
+	Total     float64   `json:"total"`
+}
+
+// httpProbeError is the JSON answer of a failed probe; the hops that
+// succeeded show where a redirect chain broke
+type httpProbeError struct {
+	Error     string    `json:"error"`
+	Redirects []httpHop `json:"redirects"`
+}
+
+// httpProbeOptions are the user-controllable knobs of a probe
+type httpProbeOptions struct {
+	Method   string
+	Body     string
+	Headers  http.Header
+	Host     string
+	Resolve  string
+	Insecure bool
+	Follow   bool
+}
+
+// httpPageHandler renders GET /http
+func httpPageHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	templates.ExecuteTemplate(w, "http.html", nil)
+}
+
+// apiHTTPHandler handles GET /api/http?url=...&method=...&body=...&headers=...&host=...&resolve=...&insecure=...&follow=...
+func apiHTTPHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	target := strings.TrimSpace(q.Get("url"))
+	if target == "" {
+		fmt.Fprint(w, `{"error":"url is required"}`)
+		return
+	}
+	if !strings.Contains(target, "://") {
+		target = "https://" + target
+	}
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		fmt.Fprint(w, `{"error":"url must be http(s)://host[:port]/..."}`)
+		return
+	}
+
+	opts := httpProbeOptions{
+		Method:   strings.ToUpper(q.Get("method")),
+		Body:     q.Get("body"),
+		Headers:  http.Header{},
+		Host:     strings.TrimSpace(q.Get("host")),
+		Resolve:  strings.TrimSpace(q.Get("resolve")),
+		Insecure: q.Get("insecure") == "true",
+		Follow:   q.Get("follow") != "false",
+	}
+	if opts.Method == "" {
+		opts.Method = http.MethodGet
+	}
+	switch opts.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+		http.MethodDelete, http.MethodOptions, http.MethodPatch:
+	default:
+		fmt.Fprint(w, `{"error":"unsupported method"}`)
+		return
+	}
+	if opts.Resolve != "" && net.ParseIP(opts.Resolve) == nil {
+		fmt.Fprint(w, `{"error":"resolve must be an IP address"}`)
+		return
+	}
+	// one "Name: value" per line
+	for _, line := range strings.Split(q.Get("headers"), "\n") {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			continue
+		}
+		opts.Headers.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), httpTimeout)
+	defer cancel()
+	res, err := probeHTTP(ctx, u, opts)
+	if err != nil {
+		data, _ := json.Marshal(httpProbeError{Error: err.Error(), Redirects: res.Redirects})
+		fmt.Fprint(w, string(data))
+		return
+	}
+	data, _ := json.Marshal(res)
+	fmt.Fprint(w, string(data))
+}
+
+// probeHTTP performs the request, following redirects by hand so every hop
+// gets its own connection and timing breakdown. On error the result still
+// holds the redirects followed so far.
+func probeHTTP(ctx context.Context, u *url.URL, opts httpProbeOptions) (*httpProbeResult, error) {
+	start := time.Now()
+	res := &httpProbeResult{URL: u.String(), Redirects: []httpHop{}}
+	method := opts.Method
+
+	for i := 0; ; i++ {
+		hop, err := httpRoundTrip(ctx, u, method, opts)
+		if err != nil {
+			if i > 0 {
+				err = fmt.Errorf("%s: %v", u, err)
+			}
+			return res, err
+		}
+		if !opts.Follow || hop.Location == "" {
+			res.Final = *hop
+			break
+		}
+		res.Redirects = append(res.Redirects, *hop)
+		if i >= httpMaxRedirects {
+			return res, fmt.Errorf("stopped after %d redirects", httpMaxRedirects)
+		}
+		next, err := u.Parse(hop.Location)
+		if err != nil {
+			return res, fmt.Errorf("bad redirect location %q", hop.Location)
+		}
+		// same rules as net/http: 301/302/303 turn into GET without a body
+		if hop.Status == http.StatusSeeOther ||
+			((hop.Status == http.StatusMovedPermanently || hop.Status == http.StatusFound) && method == http.MethodPost) {
+			method, opts.Body = http.MethodGet, ""
+		}
+		// overrides only apply to the original host
+		if next.Host != u.Host {
+			opts.Host, opts.Resolve = "", ""
+		}
+		u = next
+	}
+
+	res.Status = res.Final.Status
+	res.Proto = res.Final.Proto
+	res.Total = msSince(start)
+	return res, nil
+}
+
+// httpRoundTrip sends a single request on a fresh connection and traces it
+func httpRoundTrip(ctx context.Context, u *url.URL, method string, opts httpProbeOptions) (*httpHop, error) {
+	dialer := &net.Dialer{Timeout: httpTimeout}
+	tlsConf := &tls.Config{InsecureSkipVerify: opts.Insecure}
+	if opts.Host != "" {
+		// SNI and the certificate check follow the Host header
+		name := opts.Host
+		if h, _, err := net.SplitHostPort(name); err == nil {
+			name = h
+		}
+		tlsConf.ServerName = strings.Trim(name, "[]")
+	}
+	tr := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if opts.Resolve != "" {
+				_, port, _ := net.SplitHostPort(addr)
+				addr = net.JoinHostPort(opts.Resolve, port)
+			}
+			return dialer.DialContext(ctx, network, addr)
+		},
+		TLSClientConfig:   tlsConf,
+		ForceAttemptHTTP2: true,
+		DisableKeepAlives: true,
+	}
+	defer tr.CloseIdleConnections()
+
+	// with both address families the dialer races connections on separate
+	// goroutines (RFC 8305), so connect times are kept per address and the
+	// one GotConn reports is used
+	var (
+		mu                sync.Mutex
+		start             time.Time
+		dnsStart, dnsDone time.Time
+		connStart         = make(map[string]time.Time)
+		connDone          = make(map[string]time.Time)
+		tlsStart, tlsDone time.Time
+		firstByte         time.Time
+		remoteAddr        string
+	)
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { dnsStart = time.Now() },
+		DNSDone:  func(httptrace.DNSDoneInfo) { dnsDone = time.Now() },
+		ConnectStart: func(_, addr string) {
+			mu.Lock()
+			connStart[addr] = time.Now()
+			mu.Unlock()
+		},
+		ConnectDone: func(_, addr string, err error) {
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			connDone[addr] = time.Now()
+			mu.Unlock()
+		},
+		TLSHandshakeStart: func() { tlsStart = time.Now() },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { tlsDone = time.Now() },
+		GotConn: func(info httptrace.GotConnInfo) {
+			mu.Lock()
+			remoteAddr = info.Conn.RemoteAddr().String()
+			mu.Unlock()
+		},
+		GotFirstResponseByte: func() { firstByte = time.Now() },
+	}
+
+	var body io.Reader
+	if opts.Body != "" {
+		body = strings.NewReader(opts.Body)
+	}
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if req.Header = opts.Headers.Clone(); req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	if req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", "noc2go")
+	}
+	if opts.Host != "" {
+		req.Host = opts.Host
+	}
+
+	start = time.Now()
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	n, _ := io.Copy(io.Discard, io.LimitReader(resp.Body, httpMaxBody))
+	end := time.Now()
+	mu.Lock()
+	defer mu.Unlock()
+
+	hop := &httpHop{
+		URL:        u.String(),
+		Status:     resp.StatusCode,
+		StatusText: http.StatusText(resp.StatusCode),
+		Proto:      resp.Proto,
+		RemoteAddr: remoteAddr,
+		Headers:    resp.Header,
+		BodyBytes:  n,
+		Timing: httpTiming{
+			DNS:     msBetween(dnsStart, dnsDone),
+			Connect: msBetween(connStart[remoteAddr], connDone[remoteAddr]),
+			TLS:     msBetween(tlsStart, tlsDone),
+			TTFB:    msBetween(start, firstByte),
+			Total:   msBetween(start, end),
+		},
+	}
+	if resp.TLS != nil {
+		hop.TLSVersion = tls.VersionName(resp.TLS.Version)
+		hop.Cipher = tls.CipherSuiteName(resp.TLS.CipherSuite)
+	}
+	if resp.StatusCode >= 300 && resp.StatusCode < 400 {
+		hop.Location = resp.Header.Get("Location")
+	}
+	return hop, nil
+}
+
+// msBetween returns b-a in milliseconds, 0 if either is unset
+func msBetween(a, b time.Time) float64 {
+	if a.IsZero() || b.IsZero() {
+		return 0
+	}
+	return float64(b.Sub(a)) / float64(time.Millisecond)
+}
+
+// msSince returns the milliseconds elapsed since t
+func msSince(t time.Time) float64 {
+	return msBetween(t, time.Now())
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestProbeHTTP(t *testing.T) {
+	var gotBody, gotMethod string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/start":
+			http.Redirect(w, r, "/final", http.StatusFound)
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusTemporaryRedirect)
+		default:
+			b, _ := io.ReadAll(r.Body)
+			gotBody, gotMethod = string(b), r.Method
+			w.Header().Set("Server", "test")
+			io.WriteString(w, "hello")
+		}
+	}))
+	defer srv.Close()
+	addr := srv.Listener.Addr().String()
+
+	tests := []struct {
+		name       string
+		path       string
+		opts       httpProbeOptions
+		wantErr    bool
+		redirects  int
+		status     int
+		wantMethod string
+		wantBody   string
+	}{
+		{name: "direct", path: "/final", opts: httpProbeOptions{Method: "GET"}, status: 200, wantMethod: "GET"},
+		{
+			name: "post body", path: "/final", opts: httpProbeOptions{Method: "POST", Body: "a=1"},
+			status: 200, wantMethod: "POST", wantBody: "a=1",
+		},
+		{
+			name: "302 after post turns into get", path: "/start", opts: httpProbeOptions{Method: "POST", Body: "a=1", Follow: true},
+			redirects: 1, status: 200, wantMethod: "GET",
+		},
+		{name: "redirect not followed", path: "/start", opts: httpProbeOptions{Method: "GET"}, status: 302},
+		{name: "redirect loop keeps the hops", path: "/loop", opts: httpProbeOptions{Method: "GET", Follow: true}, wantErr: true, redirects: httpMaxRedirects + 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotBody, gotMethod = "", ""
+			u, _ := url.Parse(srv.URL + tt.path)
+			res, err := probeHTTP(context.Background(), u, tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("probeHTTP error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(res.Redirects) != tt.redirects {
+				t.Errorf("%d redirects, want %d", len(res.Redirects), tt.redirects)
+			}
+			if tt.wantErr {
+				return
+			}
+			if res.Status != tt.status || res.Final.RemoteAddr != addr {
+				t.Errorf("status %d from %s, want %d from %s", res.Status, res.Final.RemoteAddr, tt.status, addr)
+			}
+			if res.Final.Timing.Connect <= 0 || res.Final.Timing.Total < res.Final.Timing.Connect {
+				t.Errorf("timing = %+v, want a connect time within the total", res.Final.Timing)
+			}
+			if gotMethod != tt.wantMethod || gotBody != tt.wantBody {
+				t.Errorf("server got %s %q, want %s %q", gotMethod, gotBody, tt.wantMethod, tt.wantBody)
+			}
+		})
+	}
+}
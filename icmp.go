@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	pingTimeout    = 2 * time.Second
+	protocolICMP   = 1
+	protocolICMPv6 = 58
+)
+
+// pingReply is the outcome of a single echo request
+type pingReply struct {
+	Seq    int
+	TTL    int
+	RTT    float64 // milliseconds, -1 when no reply arrived
+	IP     string
+	Status string
+}
+
+// icmpPinger sends ICMP/ICMPv6 echo requests from inside the process.
+// Raw sockets are used in privileged mode, unprivileged datagram ICMP
+// sockets (Linux, macOS) otherwise.
+type icmpPinger struct {
+	conn       net.PacketConn
+	p4         *ipv4.PacketConn
+	p6         *ipv6.PacketConn
+	dst        net.Addr
+	ip         net.IP
+	v6         bool
+	privileged bool
+	id         int
+}
+
+// icmpEvent is a parsed ICMP message that refers to one of our probes
+type icmpEvent struct {
+	seq    uint16
+	ttl    int
+	from   string
+	status string
+	at     time.Time
+}
+
+// sentProbe remembers when a sequence number went out
+type sentProbe struct {
+	seq int
+	at  time.Time
+}
+
+// newICMPPinger opens an ICMP socket for ip; ttl <= 0 keeps the OS default
+func newICMPPinger(ip net.IP, privileged bool, ttl int, df bool) (*icmpPinger, error) {
+	p := &icmpPinger{
+		ip:         ip,
+		v6:         ip.To4() == nil,
+		privileged: privileged,
+		id:         rand.IntN(0xffff) + 1,
+	}
+
+	if privileged {
+		network, addr := "ip4:icmp", "0.0.0.0"
+		if p.v6 {
+			network, addr = "ip6:ipv6-icmp", "::"
+		}
+		lc := net.ListenConfig{}
+		if df {
+			lc.Control = func(_, _ string, c syscall.RawConn) error {
+				var serr error
+				if err := c.Control(func(fd uintptr) { serr = setDontFragment(fd, p.v6) }); err != nil {
+					return err
+				}
+				return serr
+			}
+		}
+		conn, err := lc.ListenPacket(context.Background(), network, addr)
+		if err != nil {
+			return nil, err
+		}
+		p.conn = conn
+		p.dst = &net.IPAddr{IP: ip}
+		if p.v6 {
+			p.p6 = ipv6.NewPacketConn(conn)
+		} else {
+			p.p4 = ipv4.NewPacketConn(conn)
+		}
+	} else {
+		if df {
+			return nil, errors.New("don't-fragment needs a raw socket (--privileged)")
+		}
+		network, addr := "udp4", "0.0.0.0"
+		if p.v6 {
+			network, addr = "udp6", "::"
+		}
+		conn, err := icmp.ListenPacket(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		p.conn = conn
+		p.dst = &net.UDPAddr{IP: ip}
+		if p.v6 {
+			p.p6 = conn.IPv6PacketConn()
+		} else {
+			p.p4 = conn.IPv4PacketConn()
+		}
+	}
+
+	// control messages carry the reply TTL; not every platform has them
+	if p.v6 {
+		_ = p.p6.SetControlMessage(ipv6.FlagHopLimit, true)
+		if ttl > 0 {
+			if err := p.p6.SetHopLimit(ttl); err != nil {
+				p.conn.Close()
+				return nil, err
+			}
+		}
+	} else {
+		_ = p.p4.SetControlMessage(ipv4.FlagTTL, true)
+		if ttl > 0 {
+			if err := p.p4.SetTTL(ttl); err != nil {
+				p.conn.Close()
+				return nil, err
+			}
+		}
+	}
+	return p, nil
+}
+
+// Close releases the socket
+func (p *icmpPinger) Close() error {
+	return p.conn.Close()
+}
+
+// run sends count echo requests spaced by interval and reports every
+// reply, error or timeout through emit. It returns once all probes are
+// answered or timed out, or when ctx is cancelled.
+func (p *icmpPinger) run(ctx context.Context, count int, interval time.Duration, size int, emit func(pingReply)) error {
+	events := make(chan icmpEvent, 16)
+	done := make(chan struct{})
+	readerDone := make(chan struct{})
+	go func() {
+		defer close(readerDone)
+		p.readLoop(events, done)
+	}()
+	defer func() {
+		close(done)
+		p.conn.SetReadDeadline(time.Now())
+		<-readerDone
+	}()
+
+	payload := make([]byte, size)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	pending := make(map[uint16]sentProbe)
+	answered := make(map[uint16]sentProbe)
+	sent := 0
+	nextSend := time.Now()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for sent < count || len(pending) > 0 {
+		wake := time.Now().Add(time.Hour)
+		if sent < count {
+			wake = nextSend
+		}
+		for _, pr := range pending {
+			if exp := pr.at.Add(pingTimeout); exp.Before(wake) {
+				wake = exp
+			}
+		}
+		timer.Reset(time.Until(wake))
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case ev := <-events:
+			pr, ok := pending[ev.seq]
+			if !ok {
+				// a second echo reply for an answered probe
+				if pr, ok = answered[ev.seq]; ok && ev.status == "received" {
+					rtt := float64(ev.at.Sub(pr.at)) / float64(time.Millisecond)
+					emit(pingReply{Seq: pr.seq, TTL: ev.ttl, RTT: rtt, IP: ev.from, Status: "duplicate"})
+				}
+				continue
+			}
+			delete(pending, ev.seq)
+			answered[ev.seq] = pr
+			rtt := -1.0
+			if ev.status == "received" {
+				rtt = float64(ev.at.Sub(pr.at)) / float64(time.Millisecond)
+			}
+			emit(pingReply{Seq: pr.seq, TTL: ev.ttl, RTT: rtt, IP: ev.from, Status: ev.status})
+
+		case now := <-timer.C:
+			if sent < count && !now.Before(nextSend) {
+				sent++
+				wire := uint16(sent)
+				at, err := p.send(wire, payload)
+				if err != nil {
+					emit(pingReply{Seq: sent, RTT: -1, IP: p.ip.String(), Status: "failure"})
+				} else {
+					pending[wire] = sentProbe{seq: sent, at: at}
+				}
+				nextSend = nextSend.Add(interval)
+			}
+			for wire, pr := range pending {
+				if now.Sub(pr.at) >= pingTimeout {
+					delete(pending, wire)
+					emit(pingReply{Seq: pr.seq, RTT: -1, IP: p.ip.String(), Status: "timeout"})
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// send writes one echo request and returns the time it left
+func (p *icmpPinger) send(seq uint16, payload []byte) (time.Time, error) {
+	var typ icmp.Type = ipv4.ICMPTypeEcho
+	if p.v6 {
+		typ = ipv6.ICMPTypeEchoRequest
+	}
+	msg := icmp.Message{
+		Type: typ,
+		Body: &icmp.Echo{ID: p.id, Seq: int(seq), Data: payload},
+	}
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	at := time.Now()
+	_, err = p.conn.WriteTo(b, p.dst)
+	return at, err
+}
+
+// readLoop parses incoming ICMP messages until the socket is closed or done
+func (p *icmpPinger) readLoop(events chan<- icmpEvent, done <-chan struct{}) {
+	buf := make([]byte, 65536)
+	for {
+		var (
+			n   int
+			ttl int
+			src net.Addr
+			err error
+		)
+		if p.v6 {
+			var cm *ipv6.ControlMessage
+			n, cm, src, err = p.p6.ReadFrom(buf)
+			if cm != nil {
+				ttl = cm.HopLimit
+			}
+		} else {
+			var cm *ipv4.ControlMessage
+			n, cm, src, err = p.p4.ReadFrom(buf)
+			if cm != nil {
+				ttl = cm.TTL
+			}
+		}
+		at := time.Now()
+		if err != nil {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return
+		}
+
+		ev, ok := p.parse(buf[:n])
+		if !ok {
+			continue
+		}
+		// raw sockets see every echo reply to this host, not only ours
+		if ev.status == "received" && addrIP(src) != p.ip.String() {
+			continue
+		}
+		ev.ttl, ev.at, ev.from = ttl, at, addrIP(src)
+		select {
+		case events <- ev:
+		case <-done:
+			return
+		}
+	}
+}
+
+// parse maps an ICMP message to the probe it answers, if any
+func (p *icmpPinger) parse(b []byte) (icmpEvent, bool) {
+	proto := protocolICMP
+	if p.v6 {
+		proto = protocolICMPv6
+	}
+	msg, err := icmp.ParseMessage(proto, b)
+	if err != nil {
+		return icmpEvent{}, false
+	}
+
+	switch msg.Type {
+	case ipv4.ICMPTypeEchoReply, ipv6.ICMPTypeEchoReply:
+		echo, ok := msg.Body.(*icmp.Echo)
+		// datagram sockets get their ID rewritten by the kernel
+		if !ok || (p.privileged && echo.ID != p.id) {
+			return icmpEvent{}, false
+		}
+		return icmpEvent{seq: uint16(echo.Seq), status: "received"}, true
+
+	case ipv4.ICMPTypeDestinationUnreachable, ipv6.ICMPTypeDestinationUnreachable:
+		if body, ok := msg.Body.(*icmp.DstUnreach); ok {
+			if seq, ok := p.quotedSeq(body.Data); ok {
+				return icmpEvent{seq: seq, status: "destination unreachable"}, true
+			}
+		}
+
+	case ipv4.ICMPTypeTimeExceeded, ipv6.ICMPTypeTimeExceeded:
+		if body, ok := msg.Body.(*icmp.TimeExceeded); ok {
+			if seq, ok := p.quotedSeq(body.Data); ok {
+				return icmpEvent{seq: seq, status: "ttl exceeded"}, true
+			}
+		}
+	}
+	return icmpEvent{}, false
+}
+
+// quotedSeq extracts our echo sequence from the datagram quoted in an ICMP error
+func (p *icmpPinger) quotedSeq(data []byte) (uint16, bool) {
+	hl, echoType := ipv6.HeaderLen, byte(ipv6.ICMPTypeEchoRequest)
+	if !p.v6 {
+		if len(data) < 1 {
+			return 0, false
+		}
+		hl, echoType = int(data[0]&0x0f)<<2, byte(ipv4.ICMPTypeEcho)
+	}
+	if len(data) < hl+8 {
+		return 0, false
+	}
+	inner := data[hl:]
+	if inner[0] != echoType {
+		return 0, false
+	}
+	if p.privileged && int(binary.BigEndian.Uint16(inner[4:6])) != p.id {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(inner[6:8]), true
+}
+
+// addrIP returns the bare IP of a socket address
+func addrIP(a net.Addr) string {
+	switch v := a.(type) {
+	case *net.IPAddr:
+		return v.IP.String()
+	case *net.UDPAddr:
+		return v.IP.String()
+	case nil:
+		return ""
+	}
+	return a.String()
+}
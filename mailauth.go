@@ -0,0 +1,984 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	spfLookupLimit     = 10 // DNS-querying terms per evaluation (RFC 7208 4.6.4)
+	spfVoidLookupLimit = 2  // lookups returning nothing
+	spfMXLimit         = 10 // address lookups per mx mechanism
+	spfMaxRecords      = 40 // include/redirect records expanded per report
+	mtaSTSTimeout      = 10 * time.Second
+	mtaSTSMaxPolicy    = 64 << 10
+)
+
+// mailCheck is the common part of every section of the report. Status is
+// ok, warning, error or missing (no record published).
+type mailCheck struct {
+	Name     string            `json:"name"`    // DNS name queried
+	Records  []string          `json:"records"` // matching TXT records
+	Tags     map[string]string `json:"tags,omitempty"`
+	Status   string            `json:"status"`
+	Errors   []string          `json:"errors,omitempty"`
+	Warnings []string          `json:"warnings,omitempty"`
+}
+
+// spfTerm is one mechanism or modifier; Include holds the expanded record
+// of include: and redirect=
+type spfTerm struct {
+	Qualifier string     `json:"qualifier,omitempty"`
+	Mechanism string     `json:"mechanism,omitempty"`
+	Modifier  string     `json:"modifier,omitempty"`
+	Value     string     `json:"value,omitempty"`
+	Lookup    bool       `json:"lookup"` // counts towards the 10-lookup limit
+	Include   *spfRecord `json:"include,omitempty"`
+}
+
+// spfRecord is the SPF policy of one domain
+type spfRecord struct {
+	Domain string    `json:"domain"`
+	Record string    `json:"record"`
+	Terms  []spfTerm `json:"terms"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// mailSPF is the SPF section with the include tree
+type mailSPF struct {
+	mailCheck
+	Lookups     int        `json:"lookups"`
+	VoidLookups int        `json:"void_lookups"`
+	MXLookups   int        `json:"mx_lookups"` // A/AAAA lookups of the MX hosts of mx mechanisms
+	Tree        *spfRecord `json:"tree,omitempty"`
+}
+
+// mailDKIM is the key published under one selector
+type mailDKIM struct {
+	mailCheck
+	Selector string `json:"selector"`
+	KeyType  string `json:"key_type,omitempty"`
+	KeyBits  int    `json:"key_bits,omitempty"`
+}
+
+// mtaSTSPolicy is the policy file served at https://mta-sts.<domain>/.well-known/mta-sts.txt
+type mtaSTSPolicy struct {
+	URL     string   `json:"url"`
+	Address string   `json:"address,omitempty"` // policy host address connected to
+	Version string   `json:"version,omitempty"`
+	Mode    string   `json:"mode,omitempty"`
+	MX      []string `json:"mx,omitempty"`
+	MaxAge  int      `json:"max_age,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// mailMTASTS is the MTA-STS section: the TXT record and the policy file
+type mailMTASTS struct {
+	mailCheck
+	Policy *mtaSTSPolicy `json:"policy,omitempty"`
+}
+
+// mailMX is one MX record of the domain
+type mailMX struct {
+	Preference uint16 `json:"preference"`
+	Host       string `json:"host"`
+}
+
+// mailReport is the JSON answer of /api/mail
+type mailReport struct {
+	Domain string      `json:"domain"`
+	Server string      `json:"server"`
+	MX     []mailMX    `json:"mx"`
+	NullMX bool        `json:"null_mx"` // "MX 0 ." - the domain accepts no mail
+	SPF    *mailSPF    `json:"spf"`
+	DMARC  *mailCheck  `json:"dmarc"`
+	DKIM   []mailDKIM  `json:"dkim"`
+	MTASTS *mailMTASTS `json:"mta_sts"`
+	TLSRPT *mailCheck  `json:"tls_rpt"`
+	BIMI   *mailCheck  `json:"bimi"`
+	Time   float64     `json:"time"` // ms
+}
+
+// mailPageHandler renders GET /mail
+func mailPageHandler(cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		templates.ExecuteTemplate(w, "mail.html", dnsPageData{CustomServers: cfg.DNS.CustomServers})
+	}
+}
+
+// apiMailHandler handles GET /api/mail?domain=...&selectors=...&server=...
+func apiMailHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	q := r.URL.Query()
+	domain := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(q.Get("domain"))), ".")
+	if domain == "" {
+		fmt.Fprint(w, `{"error":"domain is required"}`)
+		return
+	}
+	if _, ok := dns.IsDomainName(domain); !ok {
+		fmt.Fprint(w, `{"error":"invalid domain name"}`)
+		return
+	}
+	var selectors []string
+	for _, s := range strings.FieldsFunc(q.Get("selectors"), func(r rune) bool { return r == ',' || r == ' ' }) {
+		selectors = append(selectors, strings.ToLower(s))
+	}
+
+	m := &mailLookup{ctx: r.Context(), server: q.Get("server")}
+	start := time.Now()
+	rep := &mailReport{Domain: domain, MX: []mailMX{}, DKIM: []mailDKIM{}}
+	res, err := queryDNS(m.ctx, domain, "MX", m.server, dnsOptions{})
+	rep.Server = res.Server
+	if res.Msg == nil {
+		fmt.Fprintf(w, `{"error":%q}`, err.Error())
+		return
+	}
+	if res.Msg.Rcode == dns.RcodeNameError {
+		fmt.Fprintf(w, `{"error":%q}`, domain+" does not exist (NXDOMAIN)")
+		return
+	}
+	for _, rr := range res.Msg.Answer {
+		if mx, ok := rr.(*dns.MX); ok {
+			rep.MX = append(rep.MX, mailMX{mx.Preference, mx.Mx})
+			rep.NullMX = rep.NullMX || mx.Mx == "."
+		}
+	}
+
+	rep.SPF = m.checkSPF(domain, rep.NullMX)
+	rep.DMARC = m.checkDMARC(domain)
+	for _, s := range selectors {
+		rep.DKIM = append(rep.DKIM, m.checkDKIM(domain, s))
+	}
+	rep.MTASTS = m.checkMTASTS(r.Context(), domain, rep.MX)
+	rep.TLSRPT = m.checkTLSRPT(domain)
+	rep.BIMI = m.checkBIMI(domain, rep.DMARC)
+	rep.Time = float64(time.Since(start)) / float64(time.Millisecond)
+	data, _ := json.Marshal(rep)
+	fmt.Fprint(w, string(data))
+}
+
+// mailLookup runs the TXT queries of one report against one resolver;
+// they are abandoned when the request context ends
+type mailLookup struct {
+	ctx    context.Context
+	server string
+}
+
+// txt returns the TXT records of name with their strings joined; NXDOMAIN
+// and an empty answer give none
+func (m *mailLookup) txt(name string) ([]string, error) {
+	res, err := queryDNS(m.ctx, name, "TXT", m.server, dnsOptions{})
+	if res.Msg == nil {
+		return nil, err
+	}
+	switch res.Msg.Rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+	default:
+		return nil, fmt.Errorf("%s TXT: %s", name, dns.RcodeToString[res.Msg.Rcode])
+	}
+	var out []string
+	for _, rec := range answerRecords(res.Msg, dns.TypeTXT) {
+		out = append(out, rec["text"].(string))
+	}
+	return out, nil
+}
+
+// mxHosts returns the exchange names of the MX records of name; a null
+// MX, NXDOMAIN and an empty answer give none
+func (m *mailLookup) mxHosts(name string) ([]string, error) {
+	res, err := queryDNS(m.ctx, name, "MX", m.server, dnsOptions{})
+	if res.Msg == nil {
+		return nil, err
+	}
+	switch res.Msg.Rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+	default:
+		return nil, fmt.Errorf("%s MX: %s", name, dns.RcodeToString[res.Msg.Rcode])
+	}
+	var out []string
+	for _, rr := range res.Msg.Answer {
+		if mx, ok := rr.(*dns.MX); ok && mx.Mx != "." {
+			out = append(out, mx.Mx)
+		}
+	}
+	return out, nil
+}
+
+// addrs returns the A and AAAA records of name, IPv4 first
+func (m *mailLookup) addrs(name string) ([]string, error) {
+	var out []string
+	var lastErr error
+	for _, typ := range []string{"A", "AAAA"} {
+		res, err := queryDNS(m.ctx, name, typ, m.server, dnsOptions{})
+		if res.Msg == nil {
+			lastErr = err
+			continue
+		}
+		for _, rr := range res.Msg.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				out = append(out, rr.A.String())
+			case *dns.AAAA:
+				out = append(out, rr.AAAA.String())
+			}
+		}
+	}
+	if len(out) == 0 {
+		if lastErr != nil {
+			return nil, lastErr
+		}
+		return nil, fmt.Errorf("%s has no A or AAAA records", name)
+	}
+	return out, nil
+}
+
+// records fills c with the TXT records of name starting with prefix
+// (case-insensitive, as the version tags are); it reports whether exactly
+// one was found
+func (m *mailLookup) records(c *mailCheck, name, prefix string) bool {
+	c.Name, c.Records = name, []string{}
+	txt, err := m.txt(name)
+	if err != nil {
+		c.Errors = append(c.Errors, err.Error())
+	}
+	for _, t := range txt {
+		if hasVersion(t, prefix) {
+			c.Records = append(c.Records, t)
+		}
+	}
+	switch {
+	case len(c.Records) > 1:
+		c.Errors = append(c.Errors, fmt.Sprintf("%d records published, there must be exactly one", len(c.Records)))
+	case len(c.Records) == 0 && err == nil:
+		c.Status = "missing"
+	}
+	return len(c.Records) == 1
+}
+
+// hasVersion reports whether a record starts with the version tag prefix
+// followed by the end, a space or a semicolon
+func hasVersion(record, prefix string) bool {
+	r := strings.TrimSpace(record)
+	if len(r) < len(prefix) || !strings.EqualFold(r[:len(prefix)], prefix) {
+		return false
+	}
+	return len(r) == len(prefix) || strings.ContainsRune(" ;", rune(r[len(prefix)]))
+}
+
+// finish derives the status from errors and warnings
+func (c *mailCheck) finish() {
+	switch {
+	case c.Status == "missing":
+	case len(c.Errors) > 0:
+		c.Status = "error"
+	case len(c.Warnings) > 0:
+		c.Status = "warning"
+	default:
+		c.Status = "ok"
+	}
+}
+
+// parseTagList parses "k=v; k=v" as used by DKIM, DMARC, MTA-STS, TLS-RPT
+// and BIMI; tag names are lower-cased
+func parseTagList(record string) (map[string]string, []string, error) {
+	tags := make(map[string]string)
+	var order []string
+	for _, part := range strings.Split(record, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(part, "=")
+		k = strings.ToLower(strings.TrimSpace(k))
+		if !ok || k == "" {
+			return tags, order, fmt.Errorf("malformed tag %q", part)
+		}
+		if _, dup := tags[k]; dup {
+			return tags, order, fmt.Errorf("duplicate tag %q", k)
+		}
+		tags[k] = strings.TrimSpace(v)
+		order = append(order, k)
+	}
+	return tags, order, nil
+}
+
+// checkSPF parses the SPF record of domain and expands include: and
+// redirect= to count the DNS lookups
+func (m *mailLookup) checkSPF(domain string, nullMX bool) *mailSPF {
+	c := &mailSPF{}
+	if m.records(&c.mailCheck, domain, "v=spf1") {
+		e := &spfExpander{txt: m.txt, mx: m.mxHosts, path: map[string]bool{}}
+		c.Tree = e.expand(domain, c.Records[0])
+		c.Lookups, c.VoidLookups, c.MXLookups = e.lookups, e.voids, e.mxLookups
+		c.Errors = append(c.Errors, e.errors...)
+		c.Warnings = append(c.Warnings, e.warnings...)
+		if c.Lookups > spfLookupLimit {
+			c.Errors = append(c.Errors, fmt.Sprintf("%d DNS lookups, the limit is %d (permerror)", c.Lookups, spfLookupLimit))
+		}
+		if c.VoidLookups > spfVoidLookupLimit {
+			c.Errors = append(c.Errors, fmt.Sprintf("%d lookups return no records, the limit is %d (permerror)", c.VoidLookups, spfVoidLookupLimit))
+		}
+		if nullMX && strings.ToLower(strings.Join(strings.Fields(c.Records[0]), " ")) != "v=spf1 -all" {
+			c.Warnings = append(c.Warnings, `the domain has a null MX; "v=spf1 -all" is recommended`)
+		}
+	} else if c.Status == "missing" {
+		c.Warnings = append(c.Warnings, "no SPF record: receivers cannot tell which hosts may send for the domain")
+	}
+	c.finish()
+	return c
+}
+
+// spfExpander walks the include tree of one SPF record. path holds the
+// domains being expanded, so a loop is told apart from a record included
+// twice (which is expanded and counted again, as receivers do).
+type spfExpander struct {
+	txt       func(name string) ([]string, error)
+	mx        func(name string) ([]string, error)
+	path      map[string]bool
+	records   int
+	lookups   int
+	voids     int
+	mxLookups int
+	errors    []string
+	warnings  []string
+}
+
+// expand parses record (published at domain) and recursively fetches the
+// records of its include: and redirect= targets
+func (e *spfExpander) expand(domain, record string) *spfRecord {
+	e.records++
+	e.path[domain] = true
+	defer delete(e.path, domain)
+	rec := &spfRecord{Domain: domain, Record: record, Terms: []spfTerm{}}
+	where := ""
+	if e.records > 1 {
+		where = domain + ": "
+	}
+	problem := func(list *[]string, format string, args ...interface{}) {
+		*list = append(*list, where+fmt.Sprintf(format, args...))
+	}
+
+	allSeen := false
+	var redirect *spfTerm
+	for _, field := range strings.Fields(record)[1:] {
+		t := spfTerm{}
+		name, value, isModifier := strings.Cut(field, "=")
+		if isModifier && !strings.ContainsAny(name, ":/") {
+			t.Modifier, t.Value = strings.ToLower(name), value
+		} else {
+			t.Qualifier = "+"
+			if strings.ContainsRune("+-~?", rune(field[0])) {
+				t.Qualifier, field = field[:1], field[1:]
+			}
+			name, value = field, ""
+			if i := strings.IndexAny(field, ":/"); i >= 0 {
+				name, value = field[:i], strings.TrimPrefix(field[i:], ":")
+			}
+			t.Mechanism = strings.ToLower(name)
+		}
+		if allSeen && t.Mechanism != "" {
+			problem(&e.warnings, "%s after all is never evaluated", field)
+		}
+
+		switch t.Mechanism {
+		case "all":
+			allSeen = true
+			switch t.Qualifier {
+			case "+":
+				problem(&e.errors, "+all lets any host send mail for the domain")
+			case "?":
+				problem(&e.warnings, "?all is neutral and gives no protection")
+			}
+		case "include":
+			t.Lookup = true
+			if value == "" {
+				problem(&e.errors, "include without a domain")
+			} else {
+				t.Include = e.follow(value, "include")
+			}
+		case "a", "mx", "exists":
+			t.Lookup = true
+			if t.Mechanism == "exists" && value == "" {
+				problem(&e.errors, "exists without a domain")
+			}
+			if t.Mechanism == "mx" {
+				e.countMX(domain, value, problem)
+			}
+		case "ptr":
+			t.Lookup = true
+			problem(&e.warnings, "ptr is deprecated and slow (RFC 7208 5.5)")
+		case "ip4", "ip6":
+			if !validSPFNetwork(t.Mechanism, value) {
+				problem(&e.errors, "invalid %s network %q", t.Mechanism, value)
+			}
+		case "":
+			if t.Qualifier != "" {
+				problem(&e.errors, "empty mechanism %q (permerror)", field)
+				break
+			}
+			switch t.Modifier {
+			case "redirect":
+				redirect = &t
+			case "exp":
+			default:
+				// unknown modifiers are ignored by receivers
+				problem(&e.warnings, "unknown modifier %s", t.Modifier)
+			}
+		default:
+			problem(&e.errors, "unknown mechanism %q (permerror)", t.Mechanism)
+		}
+		if t.Lookup {
+			e.lookups++
+		}
+		rec.Terms = append(rec.Terms, t)
+	}
+
+	if redirect != nil {
+		if allSeen {
+			problem(&e.warnings, "redirect=%s is ignored because the record has an all mechanism", redirect.Value)
+		} else {
+			// the expanded record is attached to the stored term
+			e.lookups++
+			inc := e.follow(redirect.Value, "redirect")
+			for i := range rec.Terms {
+				if rec.Terms[i].Modifier == "redirect" {
+					rec.Terms[i].Lookup, rec.Terms[i].Include = true, inc
+				}
+			}
+		}
+	} else if !allSeen && e.records == 1 {
+		problem(&e.warnings, "no all mechanism: unmatched senders get the default neutral result")
+	}
+	return rec
+}
+
+// follow fetches and expands the SPF record of an include or redirect target
+func (e *spfExpander) follow(target, via string) *spfRecord {
+	target = strings.TrimSuffix(strings.ToLower(target), ".")
+	if strings.Contains(target, "%") {
+		e.warnings = append(e.warnings, fmt.Sprintf("%s:%s uses macros and is not expanded", via, target))
+		return nil
+	}
+	if e.path[target] {
+		e.errors = append(e.errors, fmt.Sprintf("%s:%s loops back to a record that includes it (permerror)", via, target))
+		return nil
+	}
+	if e.records >= spfMaxRecords {
+		e.errors = append(e.errors, fmt.Sprintf("%s:%s not expanded, more than %d records", via, target, spfMaxRecords))
+		return nil
+	}
+	rec := &spfRecord{Domain: target, Terms: []spfTerm{}}
+	txt, err := e.txt(target)
+	if err != nil {
+		rec.Error = err.Error()
+		e.errors = append(e.errors, fmt.Sprintf("%s:%s: %v (temperror)", via, target, err))
+		return rec
+	}
+	var spf []string
+	for _, t := range txt {
+		if hasVersion(t, "v=spf1") {
+			spf = append(spf, t)
+		}
+	}
+	switch len(spf) {
+	case 0:
+		if len(txt) == 0 {
+			e.voids++
+		}
+		rec.Error = "no SPF record"
+		e.errors = append(e.errors, fmt.Sprintf("%s:%s has no SPF record (permerror)", via, target))
+		return rec
+	case 1:
+		return e.expand(target, spf[0])
+	}
+	rec.Error = "multiple SPF records"
+	e.errors = append(e.errors, fmt.Sprintf("%s:%s publishes %d SPF records (permerror)", via, target, len(spf)))
+	return rec
+}
+
+// countMX looks up the MX hosts of an mx mechanism (value, or domain when
+// empty); each costs an A/AAAA lookup and more than 10 are a permerror
+func (e *spfExpander) countMX(domain, value string, problem func(*[]string, string, ...interface{})) {
+	target, _, _ := strings.Cut(value, "/")
+	if target == "" {
+		target = domain
+	}
+	if strings.Contains(target, "%") {
+		return // macros depend on the sender
+	}
+	hosts, err := e.mx(target)
+	switch {
+	case err != nil:
+		problem(&e.errors, "mx:%s: %v (temperror)", target, err)
+	case len(hosts) == 0:
+		e.voids++
+	case len(hosts) > spfMXLimit:
+		problem(&e.errors, "mx:%s has %d MX hosts, the limit is %d (permerror)", target, len(hosts), spfMXLimit)
+	}
+	e.mxLookups += min(len(hosts), spfMXLimit)
+}
+
+// validSPFNetwork checks the value of ip4: and ip6:
+func validSPFNetwork(mech, value string) bool {
+	addr, prefix, hasPrefix := strings.Cut(value, "/")
+	ip := net.ParseIP(addr)
+	if ip == nil || (mech == "ip4") != (ip.To4() != nil) {
+		return false
+	}
+	if !hasPrefix {
+		return true
+	}
+	bits := 32
+	if mech == "ip6" {
+		bits = 128
+	}
+	n, err := strconv.Atoi(prefix)
+	return err == nil && n >= 0 && n <= bits
+}
+
+// checkDMARC parses the policy at _dmarc.<domain>
+func (m *mailLookup) checkDMARC(domain string) *mailCheck {
+	c := &mailCheck{}
+	if !m.records(c, "_dmarc."+domain, "v=DMARC1") {
+		if c.Status == "missing" {
+			c.Warnings = append(c.Warnings, "no DMARC record at _dmarc."+domain+" (a policy of the organizational domain may apply)")
+		}
+		c.finish()
+		return c
+	}
+	tags, order, err := parseTagList(c.Records[0])
+	c.Tags = tags
+	if err != nil {
+		c.Errors = append(c.Errors, err.Error())
+	}
+	if len(order) == 0 || order[0] != "v" {
+		c.Errors = append(c.Errors, "v=DMARC1 must be the first tag")
+	}
+	switch p := strings.ToLower(tags["p"]); p {
+	case "none":
+		c.Warnings = append(c.Warnings, "p=none only monitors, failing mail is still delivered")
+	case "quarantine", "reject":
+	case "":
+		c.Errors = append(c.Errors, "required tag p is missing")
+	default:
+		c.Errors = append(c.Errors, fmt.Sprintf("invalid policy p=%s", p))
+	}
+	if sp, ok := tags["sp"]; ok {
+		switch strings.ToLower(sp) {
+		case "none", "quarantine", "reject":
+		default:
+			c.Errors = append(c.Errors, fmt.Sprintf("invalid subdomain policy sp=%s", sp))
+		}
+	}
+	if pct, ok := tags["pct"]; ok {
+		n, err := strconv.Atoi(pct)
+		switch {
+		case err != nil || n < 0 || n > 100:
+			c.Errors = append(c.Errors, fmt.Sprintf("pct=%s is not between 0 and 100", pct))
+		case n < 100:
+			c.Warnings = append(c.Warnings, fmt.Sprintf("pct=%d applies the policy to part of the failing mail only", n))
+		}
+	}
+	for _, k := range []string{"adkim", "aspf"} {
+		if v, ok := tags[k]; ok && v != "r" && v != "s" {
+			c.Errors = append(c.Errors, fmt.Sprintf("%s=%s must be r or s", k, v))
+		}
+	}
+	if ri, ok := tags["ri"]; ok {
+		if _, err := strconv.ParseUint(ri, 10, 32); err != nil {
+			c.Errors = append(c.Errors, fmt.Sprintf("ri=%s is not a number of seconds", ri))
+		}
+	}
+	if tags["rua"] == "" {
+		c.Warnings = append(c.Warnings, "no rua: you will not receive aggregate reports")
+	}
+	for _, k := range []string{"rua", "ruf"} {
+		for _, uri := range splitURIs(tags[k]) {
+			m.checkReportURI(c, domain, k, uri)
+		}
+	}
+	c.finish()
+	return c
+}
+
+// checkReportURI validates a DMARC rua/ruf destination; a mailbox outside
+// the domain must authorise the reports (RFC 7489 7.1)
+func (m *mailLookup) checkReportURI(c *mailCheck, domain, tag, uri string) {
+	// a size limit may follow the URI ("mailto:x@example.com!10m")
+	uri, _, _ = strings.Cut(uri, "!")
+	addr, ok := strings.CutPrefix(strings.ToLower(uri), "mailto:")
+	if !ok {
+		c.Errors = append(c.Errors, fmt.Sprintf("%s %s is not a mailto: URI", tag, uri))
+		return
+	}
+	a, err := mail.ParseAddress(addr)
+	if err != nil {
+		c.Errors = append(c.Errors, fmt.Sprintf("%s %s: invalid address", tag, uri))
+		return
+	}
+	host := a.Address[strings.LastIndex(a.Address, "@")+1:]
+	if dns.IsSubDomain(domain, host) || dns.IsSubDomain(host, domain) {
+		return
+	}
+	auth := domain + "._report._dmarc." + host
+	txt, err := m.txt(auth)
+	if err != nil {
+		c.Warnings = append(c.Warnings, fmt.Sprintf("%s %s: cannot check authorization: %v", tag, uri, err))
+		return
+	}
+	for _, t := range txt {
+		if hasVersion(t, "v=DMARC1") {
+			return
+		}
+	}
+	c.Warnings = append(c.Warnings, fmt.Sprintf("%s %s is outside the domain and %s does not authorise it (no %s TXT)", tag, uri, host, auth))
+}
+
+// splitURIs splits a comma-separated URI list
+func splitURIs(list string) []string {
+	var out []string
+	for _, u := range strings.Split(list, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			out = append(out, u)
+		}
+	}
+	return out
+}
+
+// checkDKIM parses the key at <selector>._domainkey.<domain>
+func (m *mailLookup) checkDKIM(domain, selector string) mailDKIM {
+	c := mailDKIM{Selector: selector}
+	name := selector + "._domainkey." + domain
+	c.Name, c.Records = name, []string{}
+	txt, err := m.txt(name)
+	if err != nil {
+		c.Errors = append(c.Errors, err.Error())
+	}
+	// v=DKIM1 is optional, any TXT record here is the key
+	for _, t := range txt {
+		if !strings.Contains(t, "=") {
+			continue
+		}
+		c.Records = append(c.Records, t)
+	}
+	switch {
+	case len(c.Records) == 0:
+		if err == nil {
+			c.Status = "missing"
+		}
+		c.finish()
+		return c
+	case len(c.Records) > 1:
+		c.Errors = append(c.Errors, fmt.Sprintf("%d records published, there must be exactly one", len(c.Records)))
+	}
+
+	tags, order, err := parseTagList(c.Records[0])
+	c.Tags = tags
+	if err != nil {
+		c.Errors = append(c.Errors, err.Error())
+	}
+	if v, ok := tags["v"]; ok && (v != "DKIM1" || order[0] != "v") {
+		c.Errors = append(c.Errors, "v must be DKIM1 and the first tag")
+	}
+	c.KeyType = strings.ToLower(tags["k"])
+	if c.KeyType == "" {
+		c.KeyType = "rsa"
+	}
+	if strings.Contains(tags["t"], "y") {
+		c.Warnings = append(c.Warnings, "t=y: the domain is testing DKIM, verifiers may ignore failures")
+	}
+	p, ok := tags["p"]
+	p = strings.Join(strings.Fields(p), "")
+	switch {
+	case !ok:
+		c.Errors = append(c.Errors, "required tag p (public key) is missing")
+	case p == "":
+		c.Warnings = append(c.Warnings, "empty p=: the key has been revoked")
+	default:
+		bits, err := dkimKeyBits(c.KeyType, p)
+		c.KeyBits = bits
+		switch {
+		case err != nil:
+			c.Errors = append(c.Errors, "public key: "+err.Error())
+		case c.KeyType == "rsa" && bits < 1024:
+			c.Errors = append(c.Errors, fmt.Sprintf("%d-bit RSA key is too short, verifiers reject keys below 1024 bits", bits))
+		case c.KeyType == "rsa" && bits < 2048:
+			c.Warnings = append(c.Warnings, fmt.Sprintf("%d-bit RSA key, 2048 bits are recommended", bits))
+		}
+	}
+	c.finish()
+	return c
+}
+
+// dkimKeyBits decodes the p= tag and returns the key size
+func dkimKeyBits(keyType, p string) (int, error) {
+	der, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return 0, errors.New("invalid base64")
+	}
+	switch keyType {
+	case "rsa":
+		key, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			// some signers publish a bare PKCS#1 RSAPublicKey
+			if rsaKey, err2 := x509.ParsePKCS1PublicKey(der); err2 == nil {
+				return rsaKey.N.BitLen(), nil
+			}
+			return 0, err
+		}
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return 0, errors.New("k=rsa but the key is not RSA")
+		}
+		return rsaKey.N.BitLen(), nil
+	case "ed25519":
+		if len(der) != 32 {
+			return 0, fmt.Errorf("Ed25519 key must be 32 bytes, not %d", len(der))
+		}
+		return 256, nil
+	}
+	return 0, fmt.Errorf("unknown key type k=%s", keyType)
+}
+
+// checkMTASTS parses _mta-sts.<domain> and fetches the policy it announces
+func (m *mailLookup) checkMTASTS(ctx context.Context, domain string, mxs []mailMX) *mailMTASTS {
+	c := &mailMTASTS{}
+	if !m.records(&c.mailCheck, "_mta-sts."+domain, "v=STSv1") {
+		c.finish()
+		return c
+	}
+	tags, order, err := parseTagList(c.Records[0])
+	c.Tags = tags
+	if err != nil {
+		c.Errors = append(c.Errors, err.Error())
+	}
+	if len(order) == 0 || order[0] != "v" {
+		c.Errors = append(c.Errors, "v=STSv1 must be the first tag")
+	}
+	if id := tags["id"]; id == "" || len(id) > 32 || strings.IndexFunc(id, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+	}) >= 0 {
+		c.Errors = append(c.Errors, "id must be 1 to 32 letters or digits")
+	}
+
+	c.Policy = m.fetchMTASTSPolicy(ctx, domain)
+	pol := c.Policy
+	if pol.Error != "" {
+		c.Errors = append(c.Errors, "policy: "+pol.Error)
+		c.finish()
+		return c
+	}
+	if pol.Version != "STSv1" {
+		c.Errors = append(c.Errors, "policy: version must be STSv1")
+	}
+	switch pol.Mode {
+	case "enforce":
+	case "testing":
+		c.Warnings = append(c.Warnings, "policy mode is testing: TLS failures are reported but mail is still delivered")
+	case "none":
+		c.Warnings = append(c.Warnings, "policy mode is none: MTA-STS is disabled")
+	default:
+		c.Errors = append(c.Errors, fmt.Sprintf("policy: invalid mode %q", pol.Mode))
+	}
+	switch {
+	case pol.MaxAge <= 0:
+		c.Errors = append(c.Errors, "policy: max_age is missing")
+	case pol.MaxAge > 31557600:
+		c.Errors = append(c.Errors, "policy: max_age is above the maximum of 31557600")
+	case pol.MaxAge < 86400:
+		c.Warnings = append(c.Warnings, fmt.Sprintf("policy: max_age %d is short, at least a week is recommended", pol.MaxAge))
+	}
+	if pol.Mode != "none" {
+		if len(pol.MX) == 0 {
+			c.Errors = append(c.Errors, "policy: no mx patterns")
+		}
+		for _, mx := range mxs {
+			if mx.Host != "." && !mtaSTSMatch(pol.MX, mx.Host) {
+				c.Errors = append(c.Errors, fmt.Sprintf("MX %s is not covered by the policy", mx.Host))
+			}
+		}
+	}
+	c.finish()
+	return c
+}
+
+// fetchMTASTSPolicy downloads and parses the policy file; redirects are
+// not followed (RFC 8461 3.3). The policy host is resolved through the
+// report's resolver like every other name; SNI and the certificate check
+// still use the host name.
+func (m *mailLookup) fetchMTASTSPolicy(ctx context.Context, domain string) *mtaSTSPolicy {
+	host := "mta-sts." + domain
+	pol := &mtaSTSPolicy{URL: "https://" + host + "/.well-known/mta-sts.txt"}
+	addrs, err := m.addrs(host)
+	if err != nil {
+		pol.Error = err.Error()
+		return pol
+	}
+	ctx, cancel := context.WithTimeout(ctx, mtaSTSTimeout)
+	defer cancel()
+	dialer := &net.Dialer{}
+	client := &http.Client{
+		Timeout: mtaSTSTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				_, port, _ := net.SplitHostPort(addr)
+				var err error
+				for _, a := range addrs {
+					var conn net.Conn
+					if conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(a, port)); err == nil {
+						pol.Address = a
+						return conn, nil
+					}
+				}
+				return nil, err
+			},
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pol.URL, nil)
+	if err != nil {
+		pol.Error = err.Error()
+		return pol
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		pol.Error = err.Error()
+		return pol
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		pol.Error = "HTTP " + resp.Status
+		return pol
+	}
+	sc := bufio.NewScanner(io.LimitReader(resp.Body, mtaSTSMaxPolicy))
+	for sc.Scan() {
+		k, v, ok := strings.Cut(sc.Text(), ":")
+		if !ok {
+			continue
+		}
+		v = strings.TrimSpace(v)
+		switch strings.ToLower(strings.TrimSpace(k)) {
+		case "version":
+			pol.Version = v
+		case "mode":
+			pol.Mode = v
+		case "mx":
+			pol.MX = append(pol.MX, strings.ToLower(v))
+		case "max_age":
+			pol.MaxAge, _ = strconv.Atoi(v)
+		}
+	}
+	return pol
+}
+
+// mtaSTSMatch matches an MX host against the policy patterns; "*." covers
+// exactly one label
+func mtaSTSMatch(patterns []string, host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, p := range patterns {
+		p = strings.TrimSuffix(p, ".")
+		if rest, ok := strings.CutPrefix(p, "*."); ok {
+			if _, parent, found := strings.Cut(host, "."); found && parent == rest {
+				return true
+			}
+		} else if p == host {
+			return true
+		}
+	}
+	return false
+}
+
+// checkTLSRPT parses the SMTP TLS reporting record at _smtp._tls.<domain>
+func (m *mailLookup) checkTLSRPT(domain string) *mailCheck {
+	c := &mailCheck{}
+	if !m.records(c, "_smtp._tls."+domain, "v=TLSRPTv1") {
+		c.finish()
+		return c
+	}
+	tags, order, err := parseTagList(c.Records[0])
+	c.Tags = tags
+	if err != nil {
+		c.Errors = append(c.Errors, err.Error())
+	}
+	if len(order) == 0 || order[0] != "v" {
+		c.Errors = append(c.Errors, "v=TLSRPTv1 must be the first tag")
+	}
+	uris := splitURIs(tags["rua"])
+	if len(uris) == 0 {
+		c.Errors = append(c.Errors, "required tag rua is missing")
+	}
+	for _, uri := range uris {
+		u, err := url.Parse(uri)
+		if err != nil || (u.Scheme != "mailto" && u.Scheme != "https") {
+			c.Errors = append(c.Errors, fmt.Sprintf("rua %s must be a mailto: or https: URI", uri))
+		}
+	}
+	c.finish()
+	return c
+}
+
+// checkBIMI parses the default BIMI assertion; logos are only shown for
+// mail passing an enforcing DMARC policy
+func (m *mailLookup) checkBIMI(domain string, dmarc *mailCheck) *mailCheck {
+	c := &mailCheck{}
+	if !m.records(c, "default._bimi."+domain, "v=BIMI1") {
+		c.finish()
+		return c
+	}
+	tags, order, err := parseTagList(c.Records[0])
+	c.Tags = tags
+	if err != nil {
+		c.Errors = append(c.Errors, err.Error())
+	}
+	if len(order) == 0 || order[0] != "v" {
+		c.Errors = append(c.Errors, "v=BIMI1 must be the first tag")
+	}
+	logo, ok := tags["l"]
+	switch {
+	case !ok:
+		c.Errors = append(c.Errors, "required tag l (logo URL) is missing")
+	case logo == "":
+		c.Warnings = append(c.Warnings, "empty l=: the domain declines to publish a logo")
+	case !strings.HasPrefix(strings.ToLower(logo), "https://"):
+		c.Errors = append(c.Errors, "logo URL must use https")
+	case !strings.HasSuffix(strings.ToLower(logo), ".svg"):
+		c.Warnings = append(c.Warnings, "logo should be an SVG Tiny PS file")
+	}
+	if a := tags["a"]; a == "" {
+		c.Warnings = append(c.Warnings, "no a= (VMC certificate): many mailbox providers only show verified logos")
+	} else if !strings.HasPrefix(strings.ToLower(a), "https://") {
+		c.Errors = append(c.Errors, "VMC URL must use https")
+	}
+	policy := strings.ToLower(dmarc.Tags["p"])
+	if policy != "quarantine" && policy != "reject" {
+		c.Errors = append(c.Errors, "BIMI needs a DMARC policy of quarantine or reject")
+	} else if pct, ok := dmarc.Tags["pct"]; ok && pct != "100" {
+		c.Errors = append(c.Errors, "BIMI needs DMARC pct=100")
+	}
+	c.finish()
+	return c
+}
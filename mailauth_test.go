@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// fakeDNS answers the TXT and MX lookups of the SPF expander from maps;
+// names missing from both give an empty answer
+type fakeDNS struct {
+	txt map[string][]string
+	mx  map[string][]string
+}
+
+func (f fakeDNS) lookupTXT(name string) ([]string, error) {
+	if name == "servfail.example" {
+		return nil, errors.New("servfail.example TXT: SERVFAIL")
+	}
+	return f.txt[name], nil
+}
+
+func (f fakeDNS) lookupMX(name string) ([]string, error) {
+	return f.mx[name], nil
+}
+
+func TestSPFExpander(t *testing.T) {
+	many := make([]string, 12)
+	for i := range many {
+		many[i] = fmt.Sprintf("mx%d.example.", i)
+	}
+	tests := []struct {
+		name       string
+		record     string
+		txt        map[string][]string
+		mx         map[string][]string
+		lookups    int
+		voids      int
+		mxLookups  int
+		wantErrors []string // substrings, one per expected error
+	}{
+		{
+			name:    "flat record",
+			record:  "v=spf1 ip4:192.0.2.0/24 a -all",
+			lookups: 1,
+		},
+		{
+			name:   "diamond is not a loop",
+			record: "v=spf1 include:a.example include:b.example -all",
+			txt: map[string][]string{
+				"a.example": {"v=spf1 include:c.example -all"},
+				"b.example": {"v=spf1 include:c.example -all"},
+				"c.example": {"v=spf1 ip4:192.0.2.1 -all"},
+			},
+			lookups: 4,
+		},
+		{
+			name:   "loop",
+			record: "v=spf1 include:a.example -all",
+			txt: map[string][]string{
+				"a.example": {"v=spf1 include:b.example -all"},
+				"b.example": {"v=spf1 include:a.example -all"},
+			},
+			lookups:    3,
+			wantErrors: []string{"include:a.example loops back"},
+		},
+		{
+			name:       "redirect to itself",
+			record:     "v=spf1 redirect=example.com",
+			lookups:    1,
+			wantErrors: []string{"redirect:example.com loops back"},
+		},
+		{
+			name:   "repeated includes count against the limit",
+			record: "v=spf1 include:a.example include:a.example include:a.example -all",
+			txt: map[string][]string{
+				"a.example": {"v=spf1 a mx exists:x.example ip4:192.0.2.1 -all"},
+			},
+			mx:        map[string][]string{"a.example": {"mx.a.example."}},
+			lookups:   12,
+			mxLookups: 3,
+		},
+		{
+			name:       "include without record",
+			record:     "v=spf1 include:none.example -all",
+			lookups:    1,
+			voids:      1,
+			wantErrors: []string{"include:none.example has no SPF record"},
+		},
+		{
+			name:       "include with lookup failure",
+			record:     "v=spf1 include:servfail.example -all",
+			lookups:    1,
+			wantErrors: []string{"include:servfail.example: servfail.example TXT: SERVFAIL"},
+		},
+		{
+			name:      "mx of the domain and of another name",
+			record:    "v=spf1 mx mx:other.example/24 -all",
+			mx:        map[string][]string{"example.com": {"mx1.example.com.", "mx2.example.com."}, "other.example": {"mx.other.example."}},
+			lookups:   2,
+			mxLookups: 3,
+		},
+		{
+			name:    "mx without records is a void lookup",
+			record:  "v=spf1 mx -all",
+			lookups: 1,
+			voids:   1,
+		},
+		{
+			name:       "mx with too many hosts",
+			record:     "v=spf1 mx -all",
+			mx:         map[string][]string{"example.com": many},
+			lookups:    1,
+			mxLookups:  10,
+			wantErrors: []string{"mx:example.com has 12 MX hosts"},
+		},
+		{
+			name:    "mx with macro is not looked up",
+			record:  "v=spf1 mx:%{d}.example -all",
+			lookups: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := fakeDNS{txt: tt.txt, mx: tt.mx}
+			e := &spfExpander{txt: f.lookupTXT, mx: f.lookupMX, path: map[string]bool{}}
+			e.expand("example.com", tt.record)
+			if e.lookups != tt.lookups || e.voids != tt.voids || e.mxLookups != tt.mxLookups {
+				t.Errorf("lookups, voids, mx lookups = %d, %d, %d, want %d, %d, %d",
+					e.lookups, e.voids, e.mxLookups, tt.lookups, tt.voids, tt.mxLookups)
+			}
+			if len(e.errors) != len(tt.wantErrors) {
+				t.Fatalf("errors = %q, want %q", e.errors, tt.wantErrors)
+			}
+			for i, want := range tt.wantErrors {
+				if !strings.Contains(e.errors[i], want) {
+					t.Errorf("error %d = %q, want it to contain %q", i, e.errors[i], want)
+				}
+			}
+		})
+	}
+}
@@ -126,6 +126,11 @@ func main() {
 		}
 	}
 
+	// servers from the config file and the command line may read ca files
+	for _, srv := range cfg.DNS.CustomServers {
+		allowUpstreamCAFile(srv)
+	}
+
 	ip := firstNonLoopbackIP()
 	fmt.Printf("[NOC2GO]   HTTPS  : https://%s:%d\n", ip, cfg.Server.Port)
 	if !confExists {
@@ -149,7 +154,23 @@ func main() {
 	mux.HandleFunc("/", rootHandler)
 	mux.HandleFunc("/info", infoHandler)
 	mux.HandleFunc("/dns", dnsPageHandler(cfg))
-	mux.HandleFunc("/api/dns", apiDNSHandler)
+	mux.HandleFunc("/api/dns", apiDNSHandler(cfg))
+	mux.HandleFunc("/api/dns/compare", apiDNSCompareHandler(cfg))
+	mux.HandleFunc("/api/dns/zonecheck", apiDNSZoneCheckHandler)
+	mux.HandleFunc("/api/dns/cache", apiDNSCacheHandler)
+	mux.HandleFunc("/api/dns/cache/flush", requireAdmin(apiDNSCacheFlushHandler))
+
+	// reverse DNS sweep
+	mux.HandleFunc("/rdns", rdnsPageHandler(cfg))
+	mux.HandleFunc("/api/dns/rdns", apiRDNSHandler(cfg))
+
+	// resolver benchmark
+	mux.HandleFunc("/dnsbench", dnsBenchPageHandler)
+	mux.HandleFunc("/api/dns/bench", apiDNSBenchHandler(cfg))
+
+	// mail authentication records
+	mux.HandleFunc("/mail", mailPageHandler(cfg))
+	mux.HandleFunc("/api/mail", apiMailHandler)
 
 	// settings
 	mux.HandleFunc("/settings", settingsPageHandler(cfg))
@@ -160,7 +181,31 @@ func main() {
 
 	// ping
 	mux.HandleFunc("/ping", pingPageHandler(cfg))
-	mux.HandleFunc("/api/ping", apiPingHandler)
+	mux.HandleFunc("/api/ping", apiPingHandler(cfg))
+
+	// traceroute
+	mux.HandleFunc("/traceroute", tracePageHandler(cfg))
+	mux.HandleFunc("/api/traceroute", apiTraceHandler(cfg))
+
+	// mtr
+	mux.HandleFunc("/mtr", mtrPageHandler(cfg))
+	mux.HandleFunc("/api/mtr", apiMTRHandler(cfg))
+
+	// port scan (admin only)
+	mux.HandleFunc("/portscan", requireAdmin(portScanPageHandler))
+	mux.HandleFunc("/api/portscan", requireAdmin(apiPortScanHandler(cfg)))
+
+	// zone transfer (admin only)
+	mux.HandleFunc("/axfr", requireAdmin(axfrPageHandler(cfg)))
+	mux.HandleFunc("/api/dns/axfr", requireAdmin(apiAXFRHandler(cfg)))
+
+	// http probe
+	mux.HandleFunc("/http", httpPageHandler)
+	mux.HandleFunc("/api/http", apiHTTPHandler)
+
+	// tls inspector
+	mux.HandleFunc("/tls", tlsPageHandler)
+	mux.HandleFunc("/api/tls", apiTLSHandler)
 
 	handler := authMiddleware(mux, cfg)
 
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// mtrHop is the running statistics of one hop, sent in every "update" frame
+type mtrHop struct {
+	Hop     int     `json:"hop"`
+	Address string  `json:"address"`
+	Name    string  `json:"name"`
+	Sent    int     `json:"sent"`
+	Recv    int     `json:"recv"`
+	Loss    float64 `json:"loss"` // percent
+	Last    float64 `json:"last"` // ms, -1 when the last probe timed out
+	Avg     float64 `json:"avg"`
+	Best    float64 `json:"best"`
+	Worst   float64 `json:"worst"`
+	StdDev  float64 `json:"stddev"`
+
+	m2 float64 // sum of squared deviations (Welford)
+}
+
+// add folds one probe result into the hop statistics
+func (h *mtrHop) add(p hopProbe) {
+	h.Sent++
+	h.Last = p.RTT
+	if p.RTT >= 0 {
+		h.Recv++
+		if h.Recv == 1 || p.RTT < h.Best {
+			h.Best = p.RTT
+		}
+		if p.RTT > h.Worst {
+			h.Worst = p.RTT
+		}
+		delta := p.RTT - h.Avg
+		h.Avg += delta / float64(h.Recv)
+		h.m2 += delta * (p.RTT - h.Avg)
+		h.StdDev = math.Sqrt(h.m2 / float64(h.Recv))
+	}
+	h.Loss = 100 * float64(h.Sent-h.Recv) / float64(h.Sent)
+}
+
+// mtrPageHandler renders GET /mtr
+func mtrPageHandler(cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		data := struct {
+			Privileged bool
+			Targets    []string
+		}{isPrivileged, cfg.Ping.Targets}
+		templates.ExecuteTemplate(w, "mtr.html", data)
+	}
+}
+
+// apiMTRHandler handles GET /api/mtr. Every cycle probes all hops of the
+// path in parallel and sends the updated per-hop statistics as one "update"
+// frame. count=0 keeps going until the client disconnects.
+func apiMTRHandler(cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+
+		maxCount := cfg.Ping.MaxCount
+		if maxCount <= 0 {
+			maxCount = defaultPingMaxCount
+		}
+		minInterval := cfg.Ping.MinInterval
+		if minInterval <= 0 {
+			minInterval = defaultPingMinInterval
+		}
+
+		cycles := intParam(q.Get("count"), 0)
+		if cycles < 0 || cycles > maxCount {
+			http.Error(w, fmt.Sprintf("count must be between 0 and %d", maxCount), http.StatusBadRequest)
+			return
+		}
+		interval := durationParam(q.Get("interval"), time.Second)
+		if interval.Seconds() < minInterval {
+			http.Error(w, fmt.Sprintf("interval must be at least %gs", minInterval), http.StatusBadRequest)
+			return
+		}
+
+		release, ok := acquireProbeSlot(w, r, cfg)
+		if !ok {
+			return
+		}
+		defer release()
+
+		t, maxHops, ok := parseTraceParams(w, r)
+		if !ok {
+			return
+		}
+		defer t.Close()
+
+		flusher, ok := startSSE(w)
+		if !ok {
+			return
+		}
+
+		ctx := r.Context()
+		hops := make([]*mtrHop, maxHops)
+		for i := range hops {
+			hops[i] = &mtrHop{Hop: i + 1, Last: -1}
+		}
+		names := make(map[string]string)
+		pathLen := maxHops // shrinks to the first TTL that reaches the target
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for cycle := 1; cycles == 0 || cycle <= cycles; cycle++ {
+			results := make([]hopProbe, pathLen)
+			var wg sync.WaitGroup
+			for i := range results {
+				wg.Add(1)
+				go func(ttl int) {
+					defer wg.Done()
+					results[ttl-1] = t.probe(ctx, ttl, traceTimeout)
+				}(i + 1)
+			}
+			wg.Wait()
+			if ctx.Err() != nil {
+				return
+			}
+
+			for i, p := range results {
+				if p.Reached && i+1 < pathLen {
+					pathLen = i + 1
+				}
+			}
+			for i := 0; i < pathLen; i++ {
+				h, p := hops[i], results[i]
+				h.add(p)
+				if p.Addr == "" || p.Addr == h.Address {
+					continue
+				}
+				h.Address = p.Addr
+				if _, ok := names[p.Addr]; !ok {
+					names[p.Addr] = reverseName(ctx, p.Addr)
+				}
+				h.Name = names[p.Addr]
+			}
+
+			data, _ := json.Marshal(map[string]interface{}{
+				"target": t.dst.String(),
+				"cycle":  cycle,
+				"hops":   hops[:pathLen],
+			})
+			fmt.Fprintf(w, "event: update\ndata: %s\n\n", data)
+			flusher.Flush()
+
+			if cycles != 0 && cycle == cycles {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+
+		data, _ := json.Marshal(map[string]interface{}{
+			"target": t.dst.String(),
+			"cycles": cycles,
+		})
+		fmt.Fprintf(w, "event: summary\ndata: %s\n\n", data)
+		flusher.Flush()
+	}
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"bufio"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"log"
 	"net"
 	"net/http"
 	"os/exec"
@@ -10,7 +13,22 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultPingMaxCount      = 1000
+	maxPingCount             = 65535 // ICMP sequence numbers are 16 bit
+	defaultPingMinInterval   = 0.2   // seconds
+	defaultPingMaxConcurrent = 2
+)
+
+var (
+	activePings = make(map[string]int) // running probes per user
+	slotMutex   sync.Mutex             // guards the slot maps of acquireSlot
 )
 
 // Serve Ping page
@@ -25,39 +43,232 @@ func pingPageHandler(cfg *Config) http.HandlerFunc {
 	}
 }
 
+// acquireSlot reserves one of the user's concurrent slots in active
+func acquireSlot(active map[string]int, user string, max int) bool {
+	slotMutex.Lock()
+	defer slotMutex.Unlock()
+	if active[user] >= max {
+		return false
+	}
+	active[user]++
+	return true
+}
+
+// acquireProbeSlot takes one of the requesting user's concurrent probe
+// slots; it answers 429 itself when none is free
+func acquireProbeSlot(w http.ResponseWriter, r *http.Request, cfg *Config) (release func(), ok bool) {
+	maxConcurrent := cfg.Ping.MaxConcurrent
+	if maxConcurrent <= 0 {
+		maxConcurrent = defaultPingMaxConcurrent
+	}
+	return acquireUserSlot(w, r, activePings, maxConcurrent)
+}
+
+// acquireUserSlot takes one of the requesting user's max slots in active
+func acquireUserSlot(w http.ResponseWriter, r *http.Request, active map[string]int, max int) (release func(), ok bool) {
+	user := "anonymous"
+	if u := currentUser(r); u != nil {
+		user = u.Name
+	}
+	if !acquireSlot(active, user, max) {
+		http.Error(w, "too many concurrent probes", http.StatusTooManyRequests)
+		return nil, false
+	}
+	return func() { releaseSlot(active, user) }, true
+}
+
+// releaseSlot frees a slot taken by acquireSlot
+func releaseSlot(active map[string]int, user string) {
+	slotMutex.Lock()
+	defer slotMutex.Unlock()
+	if active[user]--; active[user] <= 0 {
+		delete(active, user)
+	}
+}
+
 // Streamed ping via SSE
-func apiPingHandler(w http.ResponseWriter, r *http.Request) {
-	q := r.URL.Query()
-	target := q.Get("target")
-	family := q.Get("family")
-	count := q.Get("count")
-	size := q.Get("size")
-	interval := q.Get("interval")
-	ttl := q.Get("ttl")
-	df := q.Get("df")
-
-	// Resolve to an IP
-	var ipStr string
-	if p := net.ParseIP(target); p != nil {
-		ipStr = p.String()
-	} else {
-		ips, err := net.LookupIP(target)
-		if err != nil || len(ips) == 0 {
-			http.Error(w, "cannot resolve target", http.StatusBadRequest)
+func apiPingHandler(cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		target := q.Get("target")
+		family := q.Get("family")
+		size := q.Get("size")
+		ttl := q.Get("ttl")
+		df := q.Get("df")
+		mode := q.Get("mode")
+
+		// Server-side limits
+		maxCount := cfg.Ping.MaxCount
+		if maxCount <= 0 {
+			maxCount = defaultPingMaxCount
+		}
+		maxCount = min(maxCount, maxPingCount)
+		minInterval := cfg.Ping.MinInterval
+		if minInterval <= 0 {
+			minInterval = defaultPingMinInterval
+		}
+		n := intParam(q.Get("count"), 5)
+		if n < 1 || n > maxCount {
+			http.Error(w, fmt.Sprintf("count must be between 1 and %d", maxCount), http.StatusBadRequest)
 			return
 		}
-		for _, ip := range ips {
-			if family == "ipv6" && ip.To4() == nil ||
-				family != "ipv6" && ip.To4() != nil {
-				ipStr = ip.String()
-				break
+		iv := durationParam(q.Get("interval"), time.Second)
+		if iv.Seconds() < minInterval {
+			http.Error(w, fmt.Sprintf("interval must be at least %gs", minInterval), http.StatusBadRequest)
+			return
+		}
+		count := strconv.Itoa(n)
+		interval := strconv.FormatFloat(iv.Seconds(), 'f', -1, 64)
+
+		release, ok := acquireProbeSlot(w, r, cfg)
+		if !ok {
+			return
+		}
+		defer release()
+
+		// Resolve to an IP; DNS probes may name a tls://, https:// or
+		// quic:// resolver instead
+		var ipStr string
+		if mode != "dns" || !strings.Contains(target, "://") {
+			ip, err := resolveTarget(target, family)
+			if err != nil {
+				http.Error(w, "cannot resolve target", http.StatusBadRequest)
+				return
 			}
+			ipStr = ip.String()
+		}
+
+		// ICMP payload size, bounded by the largest IP datagram
+		maxSize := 65500
+		if net.ParseIP(ipStr).To4() == nil {
+			maxSize = 65527
+		}
+		sz := intParam(size, 64)
+		if sz < 0 || sz > maxSize {
+			http.Error(w, fmt.Sprintf("size must be between 0 and %d", maxSize), http.StatusBadRequest)
+			return
 		}
-		if ipStr == "" {
-			ipStr = ips[0].String()
+		if size != "" {
+			size = strconv.Itoa(sz)
 		}
+
+		// Non-ICMP probe modes
+		var probe probeFunc
+		switch mode {
+		case "", "icmp":
+		case "tcp":
+			port := intParam(q.Get("port"), 0)
+			if port < 1 || port > 65535 {
+				http.Error(w, "port must be between 1 and 65535", http.StatusBadRequest)
+				return
+			}
+			probe = tcpProbe(net.ParseIP(ipStr), port)
+		case "udp":
+			port := intParam(q.Get("port"), 0)
+			if port < 1 || port > 65535 {
+				http.Error(w, "port must be between 1 and 65535", http.StatusBadRequest)
+				return
+			}
+			payload := []byte(q.Get("payload"))
+			if h := q.Get("payload_hex"); h != "" {
+				b, err := hex.DecodeString(strings.ReplaceAll(h, " ", ""))
+				if err != nil {
+					http.Error(w, "invalid payload_hex", http.StatusBadRequest)
+					return
+				}
+				payload = b
+			}
+			probe = udpProbe(net.ParseIP(ipStr), port, payload)
+		case "dns":
+			server := target
+			if ipStr != "" {
+				port := intParam(q.Get("port"), 53)
+				if port < 1 || port > 65535 {
+					http.Error(w, "port must be between 1 and 65535", http.StatusBadRequest)
+					return
+				}
+				server = net.JoinHostPort(ipStr, strconv.Itoa(port))
+			}
+			up, err := parseUpstream(server)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			switch transport := strings.ToLower(q.Get("transport")); {
+			case transport == "":
+			case up.Proto != "udp":
+				http.Error(w, "transport only applies to plain DNS servers", http.StatusBadRequest)
+				return
+			case transport == "udp" || transport == "tcp":
+				up.Proto = transport
+			default:
+				http.Error(w, "transport must be udp or tcp", http.StatusBadRequest)
+				return
+			}
+			name := q.Get("name")
+			if name == "" {
+				name = "."
+			}
+			qtype := dns.TypeA
+			if t := q.Get("type"); t != "" {
+				var ok bool
+				if qtype, ok = dns.StringToType[strings.ToUpper(t)]; !ok {
+					http.Error(w, "unsupported record type", http.StatusBadRequest)
+					return
+				}
+			}
+			probe = dnsProbe(up, name, qtype)
+		default:
+			http.Error(w, "unsupported mode", http.StatusBadRequest)
+			return
+		}
+		if probe != nil {
+			flusher, ok := startSSE(w)
+			if !ok {
+				return
+			}
+			var replies []pingReply
+			err := runProbes(r.Context(), n, iv, probe, func(rep pingReply) {
+				replies = append(replies, rep)
+				sendReply(w, flusher, rep.Seq, rep.TTL, rep.RTT, rep.IP, rep.Status)
+			})
+			if err != nil {
+				return
+			}
+			sendSummary(w, flusher, summarizePing(n, replies))
+			return
+		}
+
+		// Prefer the in-process ICMP engine, fall back to the system binary
+		pinger, err := newICMPPinger(net.ParseIP(ipStr), isPrivileged, intParam(ttl, 0), df == "true")
+		if err != nil {
+			log.Printf("ping: native ICMP unavailable (%v), using system ping", err)
+			systemPing(w, r, ipStr, family, count, size, interval, ttl, df)
+			return
+		}
+		defer pinger.Close()
+
+		flusher, ok := startSSE(w)
+		if !ok {
+			return
+		}
+
+		var replies []pingReply
+		err = pinger.run(r.Context(), n, iv, sz, func(rep pingReply) {
+			replies = append(replies, rep)
+			sendReply(w, flusher, rep.Seq, rep.TTL, rep.RTT, rep.IP, rep.Status)
+		})
+		if err != nil {
+			// client went away
+			return
+		}
+
+		sendSummary(w, flusher, summarizePing(n, replies))
 	}
+}
 
+// systemPing runs the OS ping binary and scrapes its output
+func systemPing(w http.ResponseWriter, r *http.Request, ipStr, family, count, size, interval, ttl, df string) {
 	// Build ping command
 	args := []string{}
 	goos := runtime.GOOS
@@ -96,7 +307,7 @@ func apiPingHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	if df == "true" && goos == "linux" {
-		args = append(args, "-M", "dont")
+		args = append(args, "-M", "do")
 	}
 	if goos != "windows" {
 		args = append(args, "-D")
@@ -104,31 +315,26 @@ func apiPingHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	args = append(args, ipStr)
 
-	cmd := exec.Command("ping", args...)
+	// killed automatically when the client disconnects
+	cmd := exec.CommandContext(r.Context(), "ping", args...)
 	stdout, err := cmd.StdoutPipe()
 	if err != nil || cmd.Start() != nil {
 		http.Error(w, "failed to start ping", http.StatusInternalServerError)
 		return
 	}
 
-	// SSE setup
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	flusher, ok := w.(http.Flusher)
+	flusher, ok := startSSE(w)
 	if !ok {
-		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
 		return
 	}
 
 	// Compile regexes
-	var okRE, unreachRE, timeoutRE, failRE, pktRE, rttRE *regexp.Regexp
+	var okRE, unreachRE, timeoutRE, failRE *regexp.Regexp
 	if goos == "windows" {
 		okRE = regexp.MustCompile(`Reply from [^:]+: bytes=\d+\s+time[=<]?(\d+)?ms\s+TTL=(\d+)`)
 		unreachRE = regexp.MustCompile(`Reply from [^:]+: Destination (?:host|net) unreachable\.`)
 		timeoutRE = regexp.MustCompile(`Request timed out\.`)
 		failRE = regexp.MustCompile(`General failure\.`)
-		pktRE = regexp.MustCompile(`Packets: Sent = (\d+), Received = (\d+), Lost = (\d+) \((\d+)% loss\)`)
-		rttRE = regexp.MustCompile(`Minimum = (\d+)ms, Maximum = (\d+)ms, Average = (\d+)ms`)
 	} else {
 		// Linux & macOS
 		okRE = regexp.MustCompile(`icmp_seq=(\d+)\s+ttl=(\d+)\s+time=([\d\.]+)`)
@@ -136,9 +342,15 @@ func apiPingHandler(w http.ResponseWriter, r *http.Request) {
 		timeoutRE = regexp.MustCompile(`no answer yet for icmp_seq=(\d+)`)
 	}
 
-	scanner := bufio.NewScanner(stdout)
-	var summaryLines []string
+	// Windows output carries no sequence numbers; count probes instead
+	var replies []pingReply
+	winSeq := 0
+	emit := func(seq, ttl int, t float64, status string) {
+		replies = append(replies, pingReply{Seq: seq, TTL: ttl, RTT: t, IP: ipStr, Status: status})
+		sendReply(w, flusher, seq, ttl, t, ipStr, status)
+	}
 
+	scanner := bufio.NewScanner(stdout)
 	for scanner.Scan() {
 		line := scanner.Text()
 
@@ -148,74 +360,68 @@ func apiPingHandler(w http.ResponseWriter, r *http.Request) {
 			m := okRE.FindStringSubmatch(line)
 			var seq, ttlVal int
 			var timeMs float64
+			status := "received"
 			if goos == "windows" {
-				seq = len(summaryLines) + 1
+				winSeq++
+				seq = winSeq
 				ttlVal, _ = strconv.Atoi(m[2])
 				timeMs, _ = strconv.ParseFloat(m[1], 64)
 			} else {
 				seq, _ = strconv.Atoi(m[1])
 				ttlVal, _ = strconv.Atoi(m[2])
 				timeMs, _ = strconv.ParseFloat(m[3], 64)
+				if strings.Contains(line, "DUP!") {
+					status = "duplicate"
+				}
 			}
-			sendReply(w, flusher, seq, ttlVal, timeMs, ipStr, "received")
+			emit(seq, ttlVal, timeMs, status)
 
-		// Linux destination unreachable
-		case unreachRE != nil && unreachRE.MatchString(line):
-			m := unreachRE.FindStringSubmatch(line)
-			seq, _ := strconv.Atoi(m[1])
-			sendReply(w, flusher, seq, 0, -1, ipStr, "destination unreachable")
+		// Destination unreachable
+		case unreachRE.MatchString(line):
+			var seq int
+			if goos == "windows" {
+				winSeq++
+				seq = winSeq
+			} else {
+				seq, _ = strconv.Atoi(unreachRE.FindStringSubmatch(line)[1])
+			}
+			emit(seq, 0, -1, "destination unreachable")
 
-		// Linux timeout
-		case timeoutRE != nil && timeoutRE.MatchString(line):
-			m := timeoutRE.FindStringSubmatch(line)
-			seq, _ := strconv.Atoi(m[1])
-			sendReply(w, flusher, seq, 0, -1, ipStr, "timeout")
+		// Timeout
+		case timeoutRE.MatchString(line):
+			var seq int
+			if goos == "windows" {
+				winSeq++
+				seq = winSeq
+			} else {
+				seq, _ = strconv.Atoi(timeoutRE.FindStringSubmatch(line)[1])
+			}
+			emit(seq, 0, -1, "timeout")
 
 		// Windows general failure
 		case failRE != nil && failRE.MatchString(line):
-			seq := len(summaryLines) + 1
-			sendReply(w, flusher, seq, 0, -1, ipStr, "failure")
-
-		default:
-			summaryLines = append(summaryLines, line)
+			winSeq++
+			emit(winSeq, 0, -1, "failure")
 		}
 	}
 	_ = cmd.Wait()
+	if r.Context().Err() != nil {
+		return
+	}
 
-	// Parse summary
-	var sent, recv int
-	var loss, min, avg, max float64
+	sendSummary(w, flusher, summarizePing(intParam(count, len(replies)), replies))
+}
 
-	if goos == "windows" {
-		for _, l := range summaryLines {
-			if m := pktRE.FindStringSubmatch(l); m != nil {
-				sent, _ = strconv.Atoi(m[1])
-				recv, _ = strconv.Atoi(m[2])
-				loss, _ = strconv.ParseFloat(m[4], 64)
-			} else if m := rttRE.FindStringSubmatch(l); m != nil {
-				min, _ = strconv.ParseFloat(m[1], 64)
-				max, _ = strconv.ParseFloat(m[2], 64)
-				avg, _ = strconv.ParseFloat(m[3], 64)
-			}
-		}
-	} else {
-		for _, l := range summaryLines {
-			if strings.Contains(l, "packets transmitted") {
-				parts := strings.Split(l, ",")
-				sent, _ = strconv.Atoi(strings.Fields(parts[0])[0])
-				recv, _ = strconv.Atoi(strings.Fields(parts[1])[0])
-				lossStr := strings.TrimSuffix(strings.TrimSpace(parts[2]), "% packet loss")
-				loss, _ = strconv.ParseFloat(lossStr, 64)
-			}
-		}
+// startSSE sets the event-stream headers and returns the flusher
+func startSSE(w http.ResponseWriter) (http.Flusher, bool) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return nil, false
 	}
-
-	fmt.Fprintf(w,
-		"event: summary\n"+
-			"data: {\"sent\":%d,\"recv\":%d,\"loss\":%f,\"min\":%f,\"avg\":%f,\"max\":%f}\n\n",
-		sent, recv, loss, min, avg, max,
-	)
-	flusher.Flush()
+	return flusher, true
 }
 
 // Helper emits reply events with a status field
@@ -228,3 +434,26 @@ func sendReply(w http.ResponseWriter, f http.Flusher, seq, ttl int, t float64, i
 	)
 	f.Flush()
 }
+
+// Helper emits the final summary event
+func sendSummary(w http.ResponseWriter, f http.Flusher, sum pingSummary) {
+	data, _ := json.Marshal(sum)
+	fmt.Fprintf(w, "event: summary\ndata: %s\n\n", data)
+	f.Flush()
+}
+
+// intParam parses an integer query value, returning def when empty or invalid
+func intParam(s string, def int) int {
+	if v, err := strconv.Atoi(strings.TrimSpace(s)); err == nil {
+		return v
+	}
+	return def
+}
+
+// durationParam parses a value in (fractional) seconds
+func durationParam(s string, def time.Duration) time.Duration {
+	if v, err := strconv.ParseFloat(strings.TrimSpace(s), 64); err == nil && v > 0 {
+		return time.Duration(v * float64(time.Second))
+	}
+	return def
+}
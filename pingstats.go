@@ -0,0 +1,117 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strings"
+)
+
+// pingSummary is the payload of the final "summary" SSE event
+type pingSummary struct {
+	Sent       int     `json:"sent"`
+	Recv       int     `json:"recv"`
+	Loss       float64 `json:"loss"` // percent
+	Min        float64 `json:"min"`
+	Avg        float64 `json:"avg"`
+	Max        float64 `json:"max"`
+	Mdev       float64 `json:"mdev"`   // population deviation, as printed by iputils ping
+	Stddev     float64 `json:"stddev"` // sample standard deviation
+	Jitter     float64 `json:"jitter"` // RFC 3550 interarrival jitter over consecutive RTTs
+	Median     float64 `json:"median"`
+	P95        float64 `json:"p95"`
+	OutOfOrder int     `json:"out_of_order"`
+	Duplicates int     `json:"duplicates"`
+}
+
+// summarizePing computes loss and RTT statistics from replies in arrival order
+func summarizePing(sent int, replies []pingReply) pingSummary {
+	s := pingSummary{Sent: sent}
+	seen := make(map[int]bool)
+	maxSeq := 0
+	var rtts []float64
+
+	for _, rep := range replies {
+		if !answeredStatus(rep.Status) {
+			continue
+		}
+		if seen[rep.Seq] {
+			s.Duplicates++
+			continue
+		}
+		seen[rep.Seq] = true
+		if rep.Seq < maxSeq {
+			s.OutOfOrder++
+		} else {
+			maxSeq = rep.Seq
+		}
+		if rep.RTT >= 0 {
+			rtts = append(rtts, rep.RTT)
+		}
+	}
+	s.Recv = len(seen)
+	if sent > 0 {
+		s.Loss = math.Max(0, float64(sent-s.Recv)*100/float64(sent))
+	}
+	if len(rtts) == 0 {
+		return s
+	}
+
+	var sum, sumSq float64
+	s.Min, s.Max = rtts[0], rtts[0]
+	for i, rtt := range rtts {
+		sum += rtt
+		sumSq += rtt * rtt
+		s.Min = math.Min(s.Min, rtt)
+		s.Max = math.Max(s.Max, rtt)
+		if i > 0 {
+			// J = J + (|D| - J) / 16
+			s.Jitter += (math.Abs(rtt-rtts[i-1]) - s.Jitter) / 16
+		}
+	}
+	n := float64(len(rtts))
+	s.Avg = sum / n
+	s.Mdev = math.Sqrt(math.Max(0, sumSq/n-s.Avg*s.Avg))
+	if len(rtts) > 1 {
+		var dev float64
+		for _, rtt := range rtts {
+			dev += (rtt - s.Avg) * (rtt - s.Avg)
+		}
+		s.Stddev = math.Sqrt(dev / (n - 1))
+	}
+
+	sorted := append([]float64(nil), rtts...)
+	sort.Float64s(sorted)
+	s.Median = percentile(sorted, 50)
+	s.P95 = percentile(sorted, 95)
+	return s
+}
+
+// percentile returns the nearest-rank percentile p of sorted values
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	if p == 50 && len(sorted)%2 == 0 {
+		mid := len(sorted) / 2
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// answeredStatus reports whether a reply status means the target responded.
+// A refused TCP/UDP probe still proves the host is up and has a valid RTT;
+// DNS replies with an error RCODE are "received (RCODE)".
+func answeredStatus(status string) bool {
+	if strings.HasPrefix(status, "received") {
+		return true
+	}
+	switch status {
+	case "duplicate", "open", "refused":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSummarizePing(t *testing.T) {
+	tests := []struct {
+		name    string
+		sent    int
+		replies []pingReply
+		want    pingSummary
+	}{
+		{
+			name: "all received",
+			sent: 4,
+			replies: []pingReply{
+				{Seq: 1, RTT: 10, Status: "received"},
+				{Seq: 2, RTT: 20, Status: "received"},
+				{Seq: 3, RTT: 30, Status: "received"},
+				{Seq: 4, RTT: 40, Status: "received"},
+			},
+			want: pingSummary{
+				Sent: 4, Recv: 4, Min: 10, Avg: 25, Max: 40,
+				Mdev: math.Sqrt(125), Stddev: math.Sqrt(500.0 / 3), Jitter: 1.76025390625,
+				Median: 25, P95: 40,
+			},
+		},
+		{
+			name: "timeouts count as loss",
+			sent: 4,
+			replies: []pingReply{
+				{Seq: 1, RTT: 10, Status: "received"},
+				{Seq: 2, RTT: -1, Status: "timeout"},
+				{Seq: 3, RTT: 30, Status: "received"},
+				{Seq: 4, RTT: -1, Status: "timeout"},
+			},
+			want: pingSummary{
+				Sent: 4, Recv: 2, Loss: 50, Min: 10, Avg: 20, Max: 30,
+				Mdev: 10, Stddev: math.Sqrt(200), Jitter: 1.25, Median: 20, P95: 30,
+			},
+		},
+		{
+			name: "duplicates and reordering",
+			sent: 3,
+			replies: []pingReply{
+				{Seq: 2, RTT: 20, Status: "received"},
+				{Seq: 1, RTT: 10, Status: "received"},
+				{Seq: 1, RTT: 11, Status: "duplicate"},
+				{Seq: 3, RTT: 30, Status: "received"},
+			},
+			want: pingSummary{
+				Sent: 3, Recv: 3, Min: 10, Avg: 20, Max: 30,
+				Mdev: math.Sqrt(200.0 / 3), Stddev: 10, Jitter: 1.8359375,
+				Median: 20, P95: 30, OutOfOrder: 1, Duplicates: 1,
+			},
+		},
+		{
+			name: "refused probe is an answer",
+			sent: 1,
+			replies: []pingReply{
+				{Seq: 1, RTT: 5, Status: "refused"},
+			},
+			want: pingSummary{Sent: 1, Recv: 1, Min: 5, Avg: 5, Max: 5, Median: 5, P95: 5},
+		},
+		{
+			name: "no replies",
+			sent: 3,
+			replies: []pingReply{
+				{Seq: 1, RTT: -1, Status: "timeout"},
+				{Seq: 2, RTT: -1, Status: "failure"},
+			},
+			want: pingSummary{Sent: 3, Loss: 100},
+		},
+		{
+			name: "nothing sent",
+			want: pingSummary{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := summarizePing(tt.sent, tt.replies)
+			if got.Sent != tt.want.Sent || got.Recv != tt.want.Recv ||
+				got.OutOfOrder != tt.want.OutOfOrder || got.Duplicates != tt.want.Duplicates {
+				t.Fatalf("counts = %+v, want %+v", got, tt.want)
+			}
+			for _, f := range []struct {
+				name      string
+				got, want float64
+			}{
+				{"loss", got.Loss, tt.want.Loss},
+				{"min", got.Min, tt.want.Min},
+				{"avg", got.Avg, tt.want.Avg},
+				{"max", got.Max, tt.want.Max},
+				{"mdev", got.Mdev, tt.want.Mdev},
+				{"stddev", got.Stddev, tt.want.Stddev},
+				{"jitter", got.Jitter, tt.want.Jitter},
+				{"median", got.Median, tt.want.Median},
+				{"p95", got.P95, tt.want.P95},
+			} {
+				if math.Abs(f.got-f.want) > 1e-9 {
+					t.Errorf("%s = %v, want %v", f.name, f.got, f.want)
+				}
+			}
+		})
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	tests := []struct {
+		name   string
+		sorted []float64
+		p      float64
+		want   float64
+	}{
+		{"empty", nil, 95, 0},
+		{"single value", []float64{5}, 95, 5},
+		{"odd median", []float64{1, 2, 3}, 50, 2},
+		{"even median averages the middle", []float64{1, 2, 3, 4}, 50, 2.5},
+		{"nearest rank", []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}, 95, 19},
+		{"p95 of few values is the max", []float64{1, 2, 3}, 95, 3},
+		{"zero percentile is the min", []float64{4, 8}, 0, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := percentile(tt.sorted, tt.p); got != tt.want {
+				t.Errorf("percentile(%v, %v) = %v, want %v", tt.sorted, tt.p, got, tt.want)
+			}
+		})
+	}
+}
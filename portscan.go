@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	portScanTimeout            = 2 * time.Second
+	portScanBannerTimeout      = 2 * time.Second
+	portScanMaxHosts           = 1024
+	portScanMaxProbes          = 65536
+	defaultPortScanConcurrency = 100
+	defaultPortScanMaxRunning  = 1
+	defaultPortScanRate        = 500
+	maxPortScanRate            = 10000
+	defaultPortScanPorts       = "21,22,23,25,53,80,110,111,135,139,143,389,443,445,465,587,636,993,995,1433,1521,3306,3389,5432,5900,6379,8080,8443"
+)
+
+// activeScans counts the running scans per user, see acquireScanSlot
+var activeScans = make(map[string]int)
+
+// portServices names well-known ports in scan results
+var portServices = map[int]string{
+	21: "ftp", 22: "ssh", 23: "telnet", 25: "smtp", 53: "dns", 80: "http",
+	110: "pop3", 111: "rpcbind", 135: "msrpc", 139: "netbios-ssn", 143: "imap",
+	389: "ldap", 443: "https", 445: "microsoft-ds", 465: "smtps", 587: "submission",
+	636: "ldaps", 993: "imaps", 995: "pop3s", 1433: "mssql", 1521: "oracle",
+	3306: "mysql", 3389: "rdp", 5432: "postgresql", 5900: "vnc", 6379: "redis",
+	8000: "http-alt", 8080: "http-proxy", 8443: "https-alt",
+}
+
+// httpBannerPorts speak HTTP and get a HEAD request; the TLS ones are
+// wrapped first
+var httpBannerPorts = map[int]bool{80: false, 8000: false, 8008: false, 8080: false, 8888: false, 443: true, 8443: true}
+
+// portScanResult is the payload of a "result" SSE event
+type portScanResult struct {
+	Host    string  `json:"host"`
+	Port    int     `json:"port"`
+	State   string  `json:"state"` // open, closed or filtered
+	Service string  `json:"service,omitempty"`
+	Banner  string  `json:"banner,omitempty"`
+	RTT     float64 `json:"rtt"` // ms, -1 when filtered
+}
+
+// portScanJob is one host/port pair handed to a worker
+type portScanJob struct {
+	ip   netip.Addr
+	port int
+}
+
+// portScanPageHandler renders GET /portscan
+func portScanPageHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	templates.ExecuteTemplate(w, "portscan.html", defaultPortScanPorts)
+}
+
+// apiPortScanHandler streams GET /api/portscan?target=...&ports=...&banner=...
+// via SSE. Probes run on a bounded worker pool, paced by Config.Tools limits.
+func apiPortScanHandler(cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+
+		hosts, err := parseScanTargets(strings.TrimSpace(q.Get("target")), q.Get("family"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		spec := strings.TrimSpace(q.Get("ports"))
+		if spec == "" {
+			spec = defaultPortScanPorts
+		}
+		ports, err := parsePorts(spec)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(hosts)*len(ports) > portScanMaxProbes {
+			http.Error(w, fmt.Sprintf("scan exceeds %d host/port pairs", portScanMaxProbes), http.StatusBadRequest)
+			return
+		}
+		banner := q.Get("banner") != "false"
+
+		workers := cfg.Tools.PortScanConcurrency
+		if workers <= 0 {
+			workers = defaultPortScanConcurrency
+		}
+		rate := cfg.Tools.PortScanRate
+		if rate <= 0 {
+			rate = defaultPortScanRate
+		}
+		rate = min(rate, maxPortScanRate)
+
+		release, ok := acquireScanSlot(w, r, cfg)
+		if !ok {
+			return
+		}
+		defer release()
+
+		flusher, ok := startSSE(w)
+		if !ok {
+			return
+		}
+
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		start := time.Now()
+
+		jobs := make(chan portScanJob)
+		results := make(chan portScanResult, workers)
+		go func() {
+			defer close(jobs)
+			pace := time.NewTicker(time.Second / time.Duration(rate))
+			defer pace.Stop()
+			for _, ip := range hosts {
+				for _, port := range ports {
+					select {
+					case <-ctx.Done():
+						return
+					case <-pace.C:
+					}
+					select {
+					case <-ctx.Done():
+						return
+					case jobs <- portScanJob{ip, port}:
+					}
+				}
+			}
+		}()
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for job := range jobs {
+					res := scanPort(ctx, job.ip, job.port, banner)
+					select {
+					case results <- res:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}()
+		}
+		go func() {
+			wg.Wait()
+			close(results)
+		}()
+
+		counts := map[string]int{}
+		for res := range results {
+			counts[res.State]++
+			data, _ := json.Marshal(res)
+			fmt.Fprintf(w, "event: result\ndata: %s\n\n", data)
+			flusher.Flush()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		data, _ := json.Marshal(map[string]interface{}{
+			"hosts":    len(hosts),
+			"ports":    len(ports),
+			"open":     counts["open"],
+			"closed":   counts["closed"],
+			"filtered": counts["filtered"],
+			"elapsed":  msSince(start),
+		})
+		fmt.Fprintf(w, "event: summary\ndata: %s\n\n", data)
+		flusher.Flush()
+	}
+}
+
+// scanPort performs one TCP connect probe and optionally grabs a banner
+func scanPort(ctx context.Context, ip netip.Addr, port int, banner bool) portScanResult {
+	res := portScanResult{Host: ip.String(), Port: port, Service: portServices[port], RTT: -1}
+	addr := netip.AddrPortFrom(ip, uint16(port)).String()
+
+	dctx, cancel := context.WithTimeout(ctx, portScanTimeout)
+	defer cancel()
+	var d net.Dialer
+	start := time.Now()
+	conn, err := d.DialContext(dctx, "tcp", addr)
+	switch {
+	case err == nil:
+		res.State = "open"
+		res.RTT = msSince(start)
+	case errors.Is(err, syscall.ECONNREFUSED):
+		res.State = "closed"
+		res.RTT = msSince(start)
+		return res
+	default:
+		res.State = "filtered"
+		return res
+	}
+	defer conn.Close()
+
+	if banner {
+		res.Banner = grabBanner(conn, ip, port)
+	}
+	return res
+}
+
+// grabBanner reads the greeting of SSH/SMTP/FTP-style services, or the
+// Server header of HTTP(S) ports and of services that stay silent
+func grabBanner(conn net.Conn, ip netip.Addr, port int) string {
+	conn.SetDeadline(time.Now().Add(portScanBannerTimeout))
+
+	useTLS, isHTTP := httpBannerPorts[port]
+	if !isHTTP {
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if line = strings.TrimSpace(line); line != "" {
+			return line
+		}
+		// silent service: try HTTP before giving up
+		var ne net.Error
+		if !errors.As(err, &ne) || !ne.Timeout() {
+			return ""
+		}
+		conn.SetDeadline(time.Now().Add(portScanBannerTimeout))
+	}
+
+	if useTLS {
+		tc := tls.Client(conn, &tls.Config{InsecureSkipVerify: true, ServerName: ip.String()})
+		if err := tc.Handshake(); err != nil {
+			return ""
+		}
+		conn = tc
+	}
+	fmt.Fprintf(conn, "HEAD / HTTP/1.0\r\nHost: %s\r\nUser-Agent: noc2go\r\n\r\n", ip)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return ""
+	}
+	resp.Body.Close()
+	if s := resp.Header.Get("Server"); s != "" {
+		return s
+	}
+	return resp.Status
+}
+
+// parseScanTargets expands a host name, IP or CIDR into addresses. IPv4
+// network and broadcast addresses are skipped for prefixes shorter than /31.
+func parseScanTargets(target, family string) ([]netip.Addr, error) {
+	if target == "" {
+		return nil, errors.New("target is required")
+	}
+	if !strings.Contains(target, "/") {
+		ip, err := resolveTarget(target, family)
+		if err != nil {
+			return nil, errors.New("cannot resolve target")
+		}
+		addr, _ := netip.AddrFromSlice(ip)
+		return []netip.Addr{addr.Unmap()}, nil
+	}
+
+	prefix, err := netip.ParsePrefix(target)
+	if err != nil {
+		return nil, errors.New("invalid CIDR")
+	}
+	prefix = prefix.Masked()
+	hostBits := prefix.Addr().BitLen() - prefix.Bits()
+	if hostBits > 30 || 1<<hostBits > portScanMaxHosts {
+		return nil, fmt.Errorf("CIDR must not exceed %d addresses", portScanMaxHosts)
+	}
+	var hosts []netip.Addr
+	for a := prefix.Addr(); prefix.Contains(a); a = a.Next() {
+		hosts = append(hosts, a)
+	}
+	if prefix.Addr().Is4() && hostBits >= 2 {
+		hosts = hosts[1 : len(hosts)-1]
+	}
+	return hosts, nil
+}
+
+// acquireScanSlot takes one of the requesting admin's concurrent scan
+// slots. Scans have their own pool (Config.Tools) so a long scan does not
+// hold one of the admin's ping slots.
+func acquireScanSlot(w http.ResponseWriter, r *http.Request, cfg *Config) (release func(), ok bool) {
+	maxRunning := cfg.Tools.PortScanMaxRunning
+	if maxRunning <= 0 {
+		maxRunning = defaultPortScanMaxRunning
+	}
+	return acquireUserSlot(w, r, activeScans, maxRunning)
+}
+
+// parsePorts parses "22,80,8000-8100" into a sorted list of unique ports
+func parsePorts(spec string) ([]int, error) {
+	seen := map[int]bool{}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		lo, hi, isRange := strings.Cut(part, "-")
+		from, err1 := strconv.Atoi(strings.TrimSpace(lo))
+		to, err2 := from, error(nil)
+		if isRange {
+			to, err2 = strconv.Atoi(strings.TrimSpace(hi))
+		}
+		if err1 != nil || err2 != nil || from < 1 || to > 65535 || from > to {
+			return nil, fmt.Errorf("invalid port or range %q", part)
+		}
+		for p := from; p <= to; p++ {
+			seen[p] = true
+		}
+	}
+	if len(seen) == 0 {
+		return nil, errors.New("no ports given")
+	}
+	ports := make([]int, 0, len(seen))
+	for p := range seen {
+		ports = append(ports, p)
+	}
+	sort.Ints(ports)
+	return ports, nil
+}
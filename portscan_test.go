@@ -0,0 +1,78 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePorts(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    []int
+		wantErr bool
+	}{
+		{spec: "22", want: []int{22}},
+		{spec: "443,80,22", want: []int{22, 80, 443}},
+		{spec: "8000-8003", want: []int{8000, 8001, 8002, 8003}},
+		{spec: " 22 , 20-23 ,, 22", want: []int{20, 21, 22, 23}},
+		{spec: "65535", want: []int{65535}},
+		{spec: "1-1", want: []int{1}},
+		{spec: "", wantErr: true},
+		{spec: ",", wantErr: true},
+		{spec: "0", wantErr: true},
+		{spec: "65536", wantErr: true},
+		{spec: "100-90", wantErr: true},
+		{spec: "80-", wantErr: true},
+		{spec: "-80", wantErr: true},
+		{spec: "http", wantErr: true},
+		{spec: "22,ssh", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parsePorts(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parsePorts(%q) error = %v, wantErr %v", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parsePorts(%q) = %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestParseScanTargets(t *testing.T) {
+	tests := []struct {
+		target    string
+		wantFirst string
+		wantLast  string
+		wantLen   int
+		wantErr   bool
+	}{
+		{target: "192.0.2.10", wantFirst: "192.0.2.10", wantLast: "192.0.2.10", wantLen: 1},
+		{target: "::ffff:192.0.2.10", wantFirst: "192.0.2.10", wantLast: "192.0.2.10", wantLen: 1},
+		{target: "192.0.2.0/30", wantFirst: "192.0.2.1", wantLast: "192.0.2.2", wantLen: 2},
+		{target: "192.0.2.7/29", wantFirst: "192.0.2.1", wantLast: "192.0.2.6", wantLen: 6},
+		{target: "192.0.2.0/31", wantFirst: "192.0.2.0", wantLast: "192.0.2.1", wantLen: 2},
+		{target: "192.0.2.9/32", wantFirst: "192.0.2.9", wantLast: "192.0.2.9", wantLen: 1},
+		{target: "10.0.0.0/22", wantFirst: "10.0.0.1", wantLast: "10.0.3.254", wantLen: 1022},
+		{target: "2001:db8::/126", wantFirst: "2001:db8::", wantLast: "2001:db8::3", wantLen: 4},
+		{target: "", wantErr: true},
+		{target: "10.0.0.0/21", wantErr: true},
+		{target: "2001:db8::/64", wantErr: true},
+		{target: "192.0.2.0/33", wantErr: true},
+		{target: "not-a-cidr/24", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseScanTargets(tt.target, "")
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseScanTargets(%q) error = %v, wantErr %v", tt.target, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if len(got) != tt.wantLen || got[0].String() != tt.wantFirst || got[len(got)-1].String() != tt.wantLast {
+			t.Errorf("parseScanTargets(%q) = %d hosts %v…%v, want %d hosts %s…%s", tt.target,
+				len(got), got[0], got[len(got)-1], tt.wantLen, tt.wantFirst, tt.wantLast)
+		}
+	}
+}
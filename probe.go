@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// probeFunc performs one measurement and reports its outcome
+type probeFunc func(ctx context.Context, seq int) pingReply
+
+// runProbes calls probe count times, spaced by interval, and reports each
+// result through emit. It stops early when ctx is cancelled.
+func runProbes(ctx context.Context, count int, interval time.Duration, probe probeFunc, emit func(pingReply)) error {
+	next := time.Now()
+	for seq := 1; seq <= count; seq++ {
+		if wait := time.Until(next); wait > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(wait):
+			}
+		}
+		next = next.Add(interval)
+
+		rep := probe(ctx, seq)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		emit(rep)
+	}
+	return nil
+}
+
+// tcpProbe measures the TCP handshake time to ip:port
+func tcpProbe(ip net.IP, port int) probeFunc {
+	network := "tcp4"
+	if ip.To4() == nil {
+		network = "tcp6"
+	}
+	addr := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+	return func(ctx context.Context, seq int) pingReply {
+		d := net.Dialer{Timeout: pingTimeout}
+		start := time.Now()
+		conn, err := d.DialContext(ctx, network, addr)
+		rtt := float64(time.Since(start)) / float64(time.Millisecond)
+		rep := pingReply{Seq: seq, RTT: rtt, IP: ip.String()}
+		switch {
+		case err == nil:
+			conn.Close()
+			rep.Status = "open"
+		case errors.Is(err, syscall.ECONNREFUSED):
+			rep.Status = "refused"
+		default:
+			rep.RTT = -1
+			rep.Status = probeErrorStatus(err)
+		}
+		return rep
+	}
+}
+
+// udpProbe sends payload to ip:port and waits for any datagram back.
+// An ICMP port-unreachable surfaces as a refused read on the connected socket.
+func udpProbe(ip net.IP, port int, payload []byte) probeFunc {
+	network := "udp4"
+	if ip.To4() == nil {
+		network = "udp6"
+	}
+	addr := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+	return func(ctx context.Context, seq int) pingReply {
+		rep := pingReply{Seq: seq, RTT: -1, IP: ip.String()}
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, network, addr)
+		if err != nil {
+			rep.Status = probeErrorStatus(err)
+			return rep
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(pingTimeout))
+
+		buf := make([]byte, 2048)
+		start := time.Now()
+		if _, err = conn.Write(payload); err == nil {
+			_, err = conn.Read(buf)
+		}
+		rtt := float64(time.Since(start)) / float64(time.Millisecond)
+		switch {
+		case err == nil:
+			rep.RTT, rep.Status = rtt, "open"
+		case errors.Is(err, syscall.ECONNREFUSED):
+			rep.RTT, rep.Status = rtt, "refused"
+		default:
+			rep.Status = probeErrorStatus(err)
+		}
+		return rep
+	}
+}
+
+// dnsProbe times one uncached query for name/qtype through the resolver
+// client of the DNS tool, so DoT, DoH and DoQ resolvers can be probed too
+func dnsProbe(up *dnsUpstream, name string, qtype uint16) probeFunc {
+	host, _, _ := net.SplitHostPort(up.Addr)
+	return func(ctx context.Context, seq int) pingReply {
+		rep := pingReply{Seq: seq, RTT: -1, IP: host}
+		ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+		defer cancel()
+		msg := new(dns.Msg)
+		msg.SetQuestion(dns.Fqdn(name), qtype)
+
+		resp, rtt, err := up.exchange(ctx, msg)
+		if err != nil {
+			rep.Status = probeErrorStatus(err)
+			return rep
+		}
+		rep.RTT = float64(rtt) / float64(time.Millisecond)
+		rep.Status = "received"
+		if resp.Rcode != dns.RcodeSuccess {
+			rep.Status = "received (" + dns.RcodeToString[resp.Rcode] + ")"
+		}
+		return rep
+	}
+}
+
+// probeErrorStatus maps a dial or read error to a reply status
+func probeErrorStatus(err error) string {
+	var ne net.Error
+	switch {
+	case errors.As(err, &ne) && ne.Timeout(), errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return "destination unreachable"
+	}
+	return "failure"
+}
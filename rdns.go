@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	rdnsMaxAddresses = 4096
+	rdnsConcurrency  = 32
+)
+
+// rdnsForward is the forward lookup of one PTR target
+type rdnsForward struct {
+	Name      string   `json:"name"`
+	Addresses []string `json:"addresses"`
+	Match     bool     `json:"match"` // Addresses contains the swept address
+	Error     string   `json:"error,omitempty"`
+}
+
+// rdnsResult is the payload of a "result" event
+type rdnsResult struct {
+	Index   int           `json:"index"` // position in the prefix
+	Address string        `json:"address"`
+	Rcode   string        `json:"rcode,omitempty"`
+	PTR     []string      `json:"ptr"`
+	Forward []rdnsForward `json:"forward"`
+	Status  string        `json:"status"` // confirmed, mismatch, no_ptr or error
+	RTT     float64       `json:"rtt"`    // ms, PTR query
+	Error   string        `json:"error,omitempty"`
+}
+
+// rdnsPageHandler renders GET /rdns
+func rdnsPageHandler(cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		templates.ExecuteTemplate(w, "rdns.html", dnsPageData{CustomServers: cfg.DNS.CustomServers})
+	}
+}
+
+// apiRDNSHandler streams GET /api/dns/rdns?prefix=...&server=...&transport=...&bufsize=...&nocache=...
+// via SSE: every address of the prefix is PTR-resolved on a worker pool and
+// each PTR name is resolved forward (A or AAAA) to check that it points back
+// to the address (forward-confirmed reverse DNS).
+func apiRDNSHandler(cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		prefix, addrs, err := parseSweepPrefix(strings.TrimSpace(q.Get("prefix")))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		opts, err := parseDNSOptions(r, cfg)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		server := q.Get("server")
+
+		release, ok := acquireProbeSlot(w, r, cfg)
+		if !ok {
+			return
+		}
+		defer release()
+
+		flusher, ok := startSSE(w)
+		if !ok {
+			return
+		}
+		data, _ := json.Marshal(map[string]interface{}{"prefix": prefix.String(), "total": len(addrs), "server": chooseServer(server)})
+		fmt.Fprintf(w, "event: start\ndata: %s\n\n", data)
+		flusher.Flush()
+
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		start := time.Now()
+
+		jobs := make(chan int)
+		results := make(chan rdnsResult, rdnsConcurrency)
+		go func() {
+			defer close(jobs)
+			for i := range addrs {
+				select {
+				case <-ctx.Done():
+					return
+				case jobs <- i:
+				}
+			}
+		}()
+		var wg sync.WaitGroup
+		for i := 0; i < rdnsConcurrency && i < len(addrs); i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range jobs {
+					res := sweepAddress(ctx, i, addrs[i], server, opts)
+					select {
+					case results <- res:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}()
+		}
+		go func() {
+			wg.Wait()
+			close(results)
+		}()
+
+		counts := map[string]int{}
+		for res := range results {
+			counts[res.Status]++
+			data, _ := json.Marshal(res)
+			fmt.Fprintf(w, "event: result\ndata: %s\n\n", data)
+			flusher.Flush()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		data, _ = json.Marshal(map[string]interface{}{
+			"total":     len(addrs),
+			"confirmed": counts["confirmed"],
+			"mismatch":  counts["mismatch"],
+			"no_ptr":    counts["no_ptr"],
+			"failed":    counts["error"],
+			"elapsed":   msSince(start),
+		})
+		fmt.Fprintf(w, "event: summary\ndata: %s\n\n", data)
+		flusher.Flush()
+	}
+}
+
+// parseSweepPrefix expands an IPv4 or IPv6 prefix into all its addresses;
+// a single address sweeps just itself
+func parseSweepPrefix(s string) (netip.Prefix, []netip.Addr, error) {
+	if s == "" {
+		return netip.Prefix{}, nil, errors.New("prefix is required")
+	}
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, nil, errors.New("invalid prefix")
+		}
+		s = addr.String() + fmt.Sprintf("/%d", addr.BitLen())
+	}
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, nil, errors.New("invalid prefix")
+	}
+	prefix = prefix.Masked()
+	hostBits := prefix.Addr().BitLen() - prefix.Bits()
+	if hostBits > 30 || 1<<hostBits > rdnsMaxAddresses {
+		return prefix, nil, fmt.Errorf("prefix must not exceed %d addresses", rdnsMaxAddresses)
+	}
+	var addrs []netip.Addr
+	for a := prefix.Addr(); a.IsValid() && prefix.Contains(a); a = a.Next() {
+		addrs = append(addrs, a)
+	}
+	return prefix, addrs, nil
+}
+
+// sweepAddress resolves the PTR records of addr and checks every PTR name
+// forward; the address is confirmed when one of them points back to it
+func sweepAddress(ctx context.Context, index int, addr netip.Addr, server string, opts dnsOptions) rdnsResult {
+	res := rdnsResult{Index: index, Address: addr.String(), PTR: []string{}, Forward: []rdnsForward{}}
+	r, err := queryDNS(ctx, addr.String(), "PTR", server, opts)
+	if r.Msg == nil {
+		res.Status, res.Error = "error", err.Error()
+		return res
+	}
+	res.Rcode = dns.RcodeToString[r.Msg.Rcode]
+	res.RTT = float64(r.RTT) / float64(time.Millisecond)
+	for _, rr := range r.Msg.Answer {
+		if ptr, ok := rr.(*dns.PTR); ok {
+			res.PTR = append(res.PTR, ptr.Ptr)
+		}
+	}
+	switch {
+	case r.Msg.Rcode != dns.RcodeSuccess && r.Msg.Rcode != dns.RcodeNameError:
+		res.Status, res.Error = "error", "PTR query answered "+res.Rcode
+		return res
+	case len(res.PTR) == 0:
+		res.Status = "no_ptr"
+		return res
+	}
+
+	typ := "A"
+	if addr.Is6() {
+		typ = "AAAA"
+	}
+	res.Status = "mismatch"
+	for _, name := range res.PTR {
+		fwd := rdnsForward{Name: name, Addresses: []string{}}
+		fr, err := queryDNS(ctx, name, typ, server, opts)
+		if err != nil {
+			fwd.Error = err.Error()
+		}
+		if fr.Msg != nil {
+			for _, rr := range fr.Msg.Answer {
+				var ip net.IP
+				switch rr := rr.(type) {
+				case *dns.A:
+					ip = rr.A
+				case *dns.AAAA:
+					ip = rr.AAAA
+				default:
+					continue
+				}
+				fwd.Addresses = append(fwd.Addresses, ip.String())
+				if a, ok := netip.AddrFromSlice(ip); ok && a.Unmap() == addr {
+					fwd.Match = true
+				}
+			}
+		}
+		if fwd.Match {
+			res.Status = "confirmed"
+		}
+		res.Forward = append(res.Forward, fwd)
+	}
+	return res
+}
@@ -34,8 +34,12 @@ func settingsPageHandler(cfg *Config) http.HandlerFunc {
 	}
 }
 
-// normalizeServer ensures host:port form, appending :53 if absent
+// normalizeServer ensures host:port form, appending :53 if absent; resolver
+// URLs (tls://, https://, quic://) are kept as entered
 func normalizeServer(input string) string {
+	if strings.Contains(input, "://") {
+		return input
+	}
 	if !strings.Contains(input, ":") {
 		return input + ":53"
 	}
@@ -61,6 +65,19 @@ func apiAddDNSServerHandler(cfg *Config) http.HandlerFunc {
 			return
 		}
 		newSrv := normalizeServer(strings.TrimSpace(req.Server))
+		// a ca file is read on the noc2go host, only admins may name one;
+		// the server may read it once it is saved
+		caFile := upstreamCAIsFile(newSrv)
+		if caFile {
+			if u := currentUser(r); u == nil || u.Role != Admin {
+				json.NewEncoder(w).Encode(dnsResponse{Success: false, Error: "only admins may add a resolver with a ca file"})
+				return
+			}
+		}
+		if _, err := newUpstream(newSrv, caFile); err != nil {
+			json.NewEncoder(w).Encode(dnsResponse{Success: false, Error: err.Error()})
+			return
+		}
 		for _, s := range cfg.DNS.CustomServers {
 			if s == newSrv {
 				json.NewEncoder(w).Encode(dnsResponse{Success: false, Error: "duplicate server"})
@@ -72,6 +89,9 @@ func apiAddDNSServerHandler(cfg *Config) http.HandlerFunc {
 			json.NewEncoder(w).Encode(dnsResponse{Success: false, Error: "failed to save"})
 			return
 		}
+		if caFile {
+			allowUpstreamCAFile(newSrv)
+		}
 		json.NewEncoder(w).Encode(dnsResponse{Success: true, Servers: cfg.DNS.CustomServers})
 	}
 }
@@ -107,6 +127,7 @@ func apiRemoveDNSServerHandler(cfg *Config) http.HandlerFunc {
 			json.NewEncoder(w).Encode(dnsResponse{Success: false, Error: "failed to save"})
 			return
 		}
+		revokeUpstreamCAFile(toRemove)
 		json.NewEncoder(w).Encode(dnsResponse{Success: true, Servers: cfg.DNS.CustomServers})
 	}
 }
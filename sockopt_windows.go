@@ -0,0 +1,14 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "syscall"
+
+// setSocketTTL sets the unicast TTL / hop limit on fd before connect.
+func setSocketTTL(fd uintptr, v6 bool, ttl int) error {
+	if v6 {
+		return syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, ttl)
+	}
+	return syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IP, syscall.IP_TTL, ttl)
+}
@@ -0,0 +1,521 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	tlsTimeout        = 10 * time.Second
+	tlsRequestTimeout = time.Minute
+	tlsScanWorkers    = 8
+)
+
+// tlsStartTLSPorts are the default ports per STARTTLS protocol
+var tlsStartTLSPorts = map[string]int{
+	"":     443,
+	"smtp": 25,
+	"imap": 143,
+	"pop3": 110,
+	"ftp":  21,
+	"ldap": 389,
+	"xmpp": 5222,
+}
+
+// tlsVersions are tested from oldest to newest
+var tlsVersions = []uint16{tls.VersionTLS10, tls.VersionTLS11, tls.VersionTLS12, tls.VersionTLS13}
+
+// tlsCert describes one certificate of the presented chain
+type tlsCert struct {
+	Subject     string    `json:"subject"`
+	Issuer      string    `json:"issuer"`
+	DNSNames    []string  `json:"dns_names,omitempty"`
+	IPAddresses []string  `json:"ip_addresses,omitempty"`
+	Emails      []string  `json:"emails,omitempty"`
+	Serial      string    `json:"serial"`
+	NotBefore   time.Time `json:"not_before"`
+	NotAfter    time.Time `json:"not_after"`
+	DaysLeft    int       `json:"days_left"`
+	KeyType     string    `json:"key_type"`
+	KeySize     int       `json:"key_size"`
+	SigAlg      string    `json:"signature_algorithm"`
+	IsCA        bool      `json:"is_ca"`
+	SHA256      string    `json:"sha256"`
+}
+
+// tlsValidation is the result of verifying the chain
+type tlsValidation struct {
+	Valid bool     `json:"valid"`
+	Roots string   `json:"roots"` // system or custom
+	Error string   `json:"error,omitempty"`
+	Chain []string `json:"chain,omitempty"` // subjects of the verified path
+}
+
+// tlsOCSP describes a stapled OCSP response
+type tlsOCSP struct {
+	Stapled    bool      `json:"stapled"`
+	Status     string    `json:"status,omitempty"` // good, revoked or unknown
+	ProducedAt time.Time `json:"produced_at,omitzero"`
+	ThisUpdate time.Time `json:"this_update,omitzero"`
+	NextUpdate time.Time `json:"next_update,omitzero"`
+	RevokedAt  time.Time `json:"revoked_at,omitzero"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// tlsVersionSupport tells whether the server accepted one protocol version
+type tlsVersionSupport struct {
+	Version   string `json:"version"`
+	Supported bool   `json:"supported"`
+	Cipher    string `json:"cipher,omitempty"` // negotiated suite
+}
+
+// tlsCipher is an accepted cipher suite
+type tlsCipher struct {
+	Name     string `json:"name"`
+	ID       string `json:"id"`
+	Insecure bool   `json:"insecure"`
+}
+
+// tlsReport is the JSON answer of /api/tls
+type tlsReport struct {
+	Host       string              `json:"host"`
+	Port       int                 `json:"port"`
+	Address    string              `json:"address"`
+	StartTLS   string              `json:"starttls,omitempty"`
+	SNI        string              `json:"sni"`
+	Version    string              `json:"version"`
+	Cipher     string              `json:"cipher"`
+	ALPN       string              `json:"alpn,omitempty"`
+	Chain      []tlsCert           `json:"chain"`
+	Validation tlsValidation       `json:"validation"`
+	OCSP       tlsOCSP             `json:"ocsp"`
+	Versions   []tlsVersionSupport `json:"versions,omitempty"`
+	Ciphers    []tlsCipher         `json:"ciphers,omitempty"`
+}
+
+// tlsTarget is where and how to connect
+type tlsTarget struct {
+	addr     string
+	host     string
+	sni      string
+	starttls string
+}
+
+// tlsPageHandler renders GET /tls
+func tlsPageHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	templates.ExecuteTemplate(w, "tls.html", nil)
+}
+
+// apiTLSHandler handles /api/tls?host=...&port=...&starttls=...&sni=...&scan=...
+// The custom CA bundle (ca, PEM) may be posted as a form field.
+func apiTLSHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	host := strings.TrimSpace(r.FormValue("host"))
+	if host == "" {
+		fmt.Fprint(w, `{"error":"host is required"}`)
+		return
+	}
+	starttls := strings.ToLower(r.FormValue("starttls"))
+	defPort, ok := tlsStartTLSPorts[starttls]
+	if !ok {
+		fmt.Fprint(w, `{"error":"starttls must be smtp, imap, pop3, ftp, ldap or xmpp"}`)
+		return
+	}
+	port := intParam(r.FormValue("port"), defPort)
+	if port < 1 || port > 65535 {
+		fmt.Fprint(w, `{"error":"port must be between 1 and 65535"}`)
+		return
+	}
+	t := tlsTarget{
+		addr:     net.JoinHostPort(host, strconv.Itoa(port)),
+		host:     host,
+		sni:      strings.TrimSpace(r.FormValue("sni")),
+		starttls: starttls,
+	}
+	if t.sni == "" && net.ParseIP(host) == nil {
+		t.sni = host
+	}
+
+	var roots *x509.CertPool
+	if ca := strings.TrimSpace(r.FormValue("ca")); ca != "" {
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM([]byte(ca)) {
+			fmt.Fprint(w, `{"error":"ca contains no PEM certificates"}`)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), tlsRequestTimeout)
+	defer cancel()
+	rep, err := inspectTLS(ctx, t, roots)
+	if err != nil {
+		fmt.Fprintf(w, `{"error":%q}`, err.Error())
+		return
+	}
+	rep.Port = port
+	if r.FormValue("scan") != "false" {
+		rep.Versions, rep.Ciphers = scanTLS(ctx, t)
+	}
+	data, _ := json.Marshal(rep)
+	fmt.Fprint(w, string(data))
+}
+
+// inspectTLS performs the main handshake and analyses chain and staple
+func inspectTLS(ctx context.Context, t tlsTarget, roots *x509.CertPool) (*tlsReport, error) {
+	conn, err := dialTLS(ctx, t, &tls.Config{
+		ServerName:         t.sni,
+		InsecureSkipVerify: true, // verified below so we can report why
+		NextProtos:         []string{"h2", "http/1.1"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	st := conn.ConnectionState()
+
+	rep := &tlsReport{
+		Host:     t.host,
+		Address:  conn.RemoteAddr().String(),
+		StartTLS: t.starttls,
+		SNI:      t.sni,
+		Version:  tls.VersionName(st.Version),
+		Cipher:   tls.CipherSuiteName(st.CipherSuite),
+		ALPN:     st.NegotiatedProtocol,
+		Chain:    make([]tlsCert, 0, len(st.PeerCertificates)),
+	}
+	for _, c := range st.PeerCertificates {
+		rep.Chain = append(rep.Chain, describeCert(c))
+	}
+	if len(st.PeerCertificates) == 0 {
+		return rep, nil
+	}
+	leaf := st.PeerCertificates[0]
+
+	// chain validation
+	rep.Validation.Roots = "system"
+	if roots != nil {
+		rep.Validation.Roots = "custom"
+	}
+	inter := x509.NewCertPool()
+	for _, c := range st.PeerCertificates[1:] {
+		inter.AddCert(c)
+	}
+	name := t.sni
+	if name == "" {
+		name = t.host
+	}
+	chains, err := leaf.Verify(x509.VerifyOptions{DNSName: name, Roots: roots, Intermediates: inter})
+	if err != nil {
+		rep.Validation.Error = err.Error()
+	} else {
+		rep.Validation.Valid = true
+		for _, c := range chains[0] {
+			rep.Validation.Chain = append(rep.Validation.Chain, c.Subject.String())
+		}
+	}
+
+	// OCSP staple; the issuer comes from the verified or presented chain
+	if len(st.OCSPResponse) > 0 {
+		rep.OCSP.Stapled = true
+		var issuer *x509.Certificate
+		if len(chains) > 0 && len(chains[0]) > 1 {
+			issuer = chains[0][1]
+		} else if len(st.PeerCertificates) > 1 {
+			issuer = st.PeerCertificates[1]
+		}
+		resp, err := ocsp.ParseResponseForCert(st.OCSPResponse, leaf, issuer)
+		if err != nil {
+			rep.OCSP.Error = err.Error()
+		} else {
+			rep.OCSP.Status = map[int]string{ocsp.Good: "good", ocsp.Revoked: "revoked"}[resp.Status]
+			if rep.OCSP.Status == "" {
+				rep.OCSP.Status = "unknown"
+			}
+			rep.OCSP.ProducedAt = resp.ProducedAt
+			rep.OCSP.ThisUpdate = resp.ThisUpdate
+			rep.OCSP.NextUpdate = resp.NextUpdate
+			rep.OCSP.RevokedAt = resp.RevokedAt
+		}
+	}
+	return rep, nil
+}
+
+// scanTLS tries every protocol version and every cipher suite Go
+// implements. TLS 1.3 suites are not configurable, so only the negotiated
+// one is listed.
+func scanTLS(ctx context.Context, t tlsTarget) ([]tlsVersionSupport, []tlsCipher) {
+	versions := make([]tlsVersionSupport, len(tlsVersions))
+	var suites []*tls.CipherSuite
+	suites = append(suites, tls.CipherSuites()...)
+	suites = append(suites, tls.InsecureCipherSuites()...)
+	accepted := make([]bool, len(suites))
+
+	type job func()
+	jobs := make(chan job)
+	var wg sync.WaitGroup
+	for i := 0; i < tlsScanWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				j()
+			}
+		}()
+	}
+
+	for i, v := range tlsVersions {
+		jobs <- func() {
+			versions[i] = tlsVersionSupport{Version: tls.VersionName(v)}
+			conn, err := dialTLS(ctx, t, &tls.Config{
+				ServerName: t.sni, InsecureSkipVerify: true, MinVersion: v, MaxVersion: v,
+			})
+			if err == nil {
+				versions[i].Supported = true
+				versions[i].Cipher = tls.CipherSuiteName(conn.ConnectionState().CipherSuite)
+				conn.Close()
+			}
+		}
+	}
+	for i, s := range suites {
+		if !supportsPreTLS13(s) {
+			continue
+		}
+		jobs <- func() {
+			conn, err := dialTLS(ctx, t, &tls.Config{
+				ServerName: t.sni, InsecureSkipVerify: true,
+				MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS12,
+				CipherSuites: []uint16{s.ID},
+			})
+			if err == nil {
+				accepted[i] = true
+				conn.Close()
+			}
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	ciphers := []tlsCipher{}
+	for i, s := range suites {
+		if accepted[i] {
+			ciphers = append(ciphers, tlsCipher{Name: s.Name, ID: fmt.Sprintf("0x%04x", s.ID), Insecure: s.Insecure})
+		}
+	}
+	if v13 := versions[len(versions)-1]; v13.Supported {
+		for _, s := range tls.CipherSuites() {
+			if s.Name == v13.Cipher {
+				ciphers = append(ciphers, tlsCipher{Name: s.Name, ID: fmt.Sprintf("0x%04x", s.ID)})
+			}
+		}
+	}
+	return versions, ciphers
+}
+
+// supportsPreTLS13 reports whether s can be negotiated below TLS 1.3
+func supportsPreTLS13(s *tls.CipherSuite) bool {
+	for _, v := range s.SupportedVersions {
+		if v != tls.VersionTLS13 {
+			return true
+		}
+	}
+	return false
+}
+
+// dialTLS connects, runs the STARTTLS dialogue if requested and completes
+// the TLS handshake with cfg
+func dialTLS(ctx context.Context, t tlsTarget, cfg *tls.Config) (*tls.Conn, error) {
+	d := net.Dialer{Timeout: tlsTimeout}
+	raw, err := d.DialContext(ctx, "tcp", t.addr)
+	if err != nil {
+		return nil, err
+	}
+	raw.SetDeadline(time.Now().Add(tlsTimeout))
+	if t.starttls != "" {
+		if err := startTLS(raw, t.starttls, t.host); err != nil {
+			raw.Close()
+			return nil, fmt.Errorf("starttls: %w", err)
+		}
+	}
+	conn := tls.Client(raw, cfg)
+	if err := conn.HandshakeContext(ctx); err != nil {
+		raw.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// startTLS upgrades a plain-text session of the given protocol
+func startTLS(conn net.Conn, proto, host string) error {
+	br := bufio.NewReader(conn)
+	switch proto {
+	case "smtp":
+		if _, err := readReply(br, "220"); err != nil {
+			return err
+		}
+		fmt.Fprint(conn, "EHLO noc2go\r\n")
+		if _, err := readReply(br, "250"); err != nil {
+			return err
+		}
+		fmt.Fprint(conn, "STARTTLS\r\n")
+		_, err := readReply(br, "220")
+		return err
+
+	case "ftp":
+		if _, err := readReply(br, "220"); err != nil {
+			return err
+		}
+		fmt.Fprint(conn, "AUTH TLS\r\n")
+		_, err := readReply(br, "234")
+		return err
+
+	case "pop3":
+		if _, err := readReply(br, "+OK"); err != nil {
+			return err
+		}
+		fmt.Fprint(conn, "STLS\r\n")
+		_, err := readReply(br, "+OK")
+		return err
+
+	case "imap":
+		if _, err := readReply(br, "* OK"); err != nil {
+			return err
+		}
+		fmt.Fprint(conn, "a1 STARTTLS\r\n")
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				return err
+			}
+			if strings.HasPrefix(line, "a1 ") {
+				if !strings.HasPrefix(line, "a1 OK") {
+					return errors.New(strings.TrimSpace(line))
+				}
+				return nil
+			}
+		}
+
+	case "ldap":
+		// ExtendedRequest with the StartTLS OID 1.3.6.1.4.1.1466.20037
+		oid := "1.3.6.1.4.1.1466.20037"
+		req := []byte{0x30, byte(7 + len(oid)), 0x02, 0x01, 0x01, 0x77, byte(2 + len(oid)), 0x80, byte(len(oid))}
+		conn.Write(append(req, oid...))
+		buf := make([]byte, 512)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return err
+		}
+		// ExtendedResponse (0x78) starts with the ENUMERATED resultCode
+		i := bytes.IndexByte(buf[:n], 0x78)
+		if i < 0 || i+5 > n || buf[i+2] != 0x0a || buf[i+3] != 0x01 {
+			return errors.New("unexpected LDAP response")
+		}
+		if code := buf[i+4]; code != 0 {
+			return fmt.Errorf("LDAP resultCode %d", code)
+		}
+		return nil
+
+	case "xmpp":
+		fmt.Fprintf(conn, "<?xml version='1.0'?><stream:stream xmlns='jabber:client' "+
+			"xmlns:stream='http://etherx.jabber.org/streams' to='%s' version='1.0'>", host)
+		if err := readUntil(br, "</stream:features>"); err != nil {
+			return err
+		}
+		fmt.Fprint(conn, "<starttls xmlns='urn:ietf:params:xml:ns:xmpp-tls'/>")
+		return readUntil(br, "<proceed")
+	}
+	return fmt.Errorf("unsupported protocol %q", proto)
+}
+
+// readReply reads a (multi-line) text protocol reply and checks its prefix
+func readReply(br *bufio.Reader, want string) (string, error) {
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		// SMTP/FTP continuation lines look like "250-..."
+		if len(line) > 3 && line[3] == '-' && want[0] != '+' && want[0] != '*' {
+			continue
+		}
+		if !strings.HasPrefix(line, want) {
+			return "", errors.New(line)
+		}
+		return line, nil
+	}
+}
+
+// readUntil consumes input until marker has been seen
+func readUntil(br *bufio.Reader, marker string) error {
+	var seen strings.Builder
+	buf := make([]byte, 1024)
+	for seen.Len() < 64<<10 {
+		n, err := br.Read(buf)
+		seen.Write(buf[:n])
+		if strings.Contains(seen.String(), marker) {
+			return nil
+		}
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+	}
+	return fmt.Errorf("no %s from server", marker)
+}
+
+// describeCert extracts the report fields of one certificate
+func describeCert(c *x509.Certificate) tlsCert {
+	fp := sha256.Sum256(c.Raw)
+	out := tlsCert{
+		Subject:   c.Subject.String(),
+		Issuer:    c.Issuer.String(),
+		DNSNames:  c.DNSNames,
+		Emails:    c.EmailAddresses,
+		Serial:    c.SerialNumber.Text(16),
+		NotBefore: c.NotBefore,
+		NotAfter:  c.NotAfter,
+		DaysLeft:  int(time.Until(c.NotAfter).Hours() / 24),
+		SigAlg:    c.SignatureAlgorithm.String(),
+		IsCA:      c.IsCA,
+		SHA256:    hex.EncodeToString(fp[:]),
+	}
+	for _, ip := range c.IPAddresses {
+		out.IPAddresses = append(out.IPAddresses, ip.String())
+	}
+	switch k := c.PublicKey.(type) {
+	case *rsa.PublicKey:
+		out.KeyType, out.KeySize = "RSA", k.N.BitLen()
+	case *ecdsa.PublicKey:
+		out.KeyType, out.KeySize = "ECDSA "+k.Curve.Params().Name, k.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		out.KeyType, out.KeySize = "Ed25519", 256
+	default:
+		out.KeyType = c.PublicKeyAlgorithm.String()
+	}
+	return out
+}
@@ -0,0 +1,541 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	traceTimeout         = time.Second
+	traceProbesPerHop    = 3
+	defaultTraceMaxHops  = 30
+	maxTraceHops         = 64
+	defaultTraceUDPPort  = 33434
+	defaultTraceTCPPort  = 80
+	protocolTCP          = 6
+	protocolUDP          = 17
+	traceLocalPortBase   = 33000
+	traceLocalPortSpread = 28000
+)
+
+// hopProbe is the answer to one TTL-limited probe
+type hopProbe struct {
+	Addr    string  // responding router or the target, "" on timeout
+	RTT     float64 // milliseconds, -1 on timeout
+	Reached bool    // the destination itself answered
+}
+
+// traceEvent is a parsed ICMP error or reply delivered to a waiting probe
+type traceEvent struct {
+	from string
+	at   time.Time
+}
+
+// tracer sends TTL-limited probes towards one destination. In privileged
+// mode a single raw ICMP socket collects Time Exceeded / Unreachable / Echo
+// Reply messages for all methods and hands them to the waiting probe; without
+// privileges each probe reads the kernel error queue of its own socket
+// (Linux only). probe is safe for concurrent use.
+type tracer struct {
+	method     string // icmp, udp or tcp
+	dst        net.IP
+	v6         bool
+	port       int
+	privileged bool
+	id         int
+	seq        atomic.Uint32
+
+	conn    *icmp.PacketConn
+	sendMu  sync.Mutex
+	mu      sync.Mutex
+	waiters map[string]chan traceEvent
+	done    chan struct{}
+}
+
+// newTracer prepares a tracer; port is the UDP base port or TCP port
+func newTracer(dst net.IP, method string, port int, privileged bool) (*tracer, error) {
+	t := &tracer{
+		method:     method,
+		dst:        dst,
+		v6:         dst.To4() == nil,
+		port:       port,
+		privileged: privileged,
+		id:         rand.IntN(0xffff) + 1,
+		waiters:    make(map[string]chan traceEvent),
+		done:       make(chan struct{}),
+	}
+	if !privileged {
+		if err := recvErrSupported(method); err != nil {
+			return nil, err
+		}
+		return t, nil
+	}
+
+	network, addr := "ip4:icmp", "0.0.0.0"
+	if t.v6 {
+		network, addr = "ip6:ipv6-icmp", "::"
+	}
+	conn, err := icmp.ListenPacket(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	t.conn = conn
+	go t.readLoop()
+	return t, nil
+}
+
+// Close stops the raw listener
+func (t *tracer) Close() error {
+	if t.conn == nil {
+		return nil
+	}
+	close(t.done)
+	return t.conn.Close()
+}
+
+// probe sends one probe with the given TTL and waits up to timeout
+func (t *tracer) probe(ctx context.Context, ttl int, timeout time.Duration) hopProbe {
+	if !t.privileged {
+		return t.recvErrProbe(ctx, ttl, timeout)
+	}
+	switch t.method {
+	case "udp":
+		return t.rawUDPProbe(ctx, ttl, timeout)
+	case "tcp":
+		return t.rawTCPProbe(ctx, ttl, timeout)
+	}
+	return t.rawICMPProbe(ctx, ttl, timeout)
+}
+
+// register announces interest in messages matching key
+func (t *tracer) register(key string) chan traceEvent {
+	ch := make(chan traceEvent, 1)
+	t.mu.Lock()
+	t.waiters[key] = ch
+	t.mu.Unlock()
+	return ch
+}
+
+// unregister removes a waiter added by register
+func (t *tracer) unregister(key string) {
+	t.mu.Lock()
+	delete(t.waiters, key)
+	t.mu.Unlock()
+}
+
+// await waits for the event on ch and converts it into a hopProbe
+func (t *tracer) await(ctx context.Context, ch chan traceEvent, sent time.Time, timeout time.Duration) hopProbe {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case ev := <-ch:
+		return hopProbe{
+			Addr:    ev.from,
+			RTT:     float64(ev.at.Sub(sent)) / float64(time.Millisecond),
+			Reached: ev.from == t.dst.String(),
+		}
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return hopProbe{RTT: -1}
+}
+
+// rawICMPProbe sends an echo request with a limited TTL on the raw socket
+func (t *tracer) rawICMPProbe(ctx context.Context, ttl int, timeout time.Duration) hopProbe {
+	seq := uint16(t.seq.Add(1))
+	key := fmt.Sprintf("%d/%d", protocolICMP, seq)
+	ch := t.register(key)
+	defer t.unregister(key)
+
+	var typ icmp.Type = ipv4.ICMPTypeEcho
+	if t.v6 {
+		typ = ipv6.ICMPTypeEchoRequest
+	}
+	msg := icmp.Message{Type: typ, Body: &icmp.Echo{ID: t.id, Seq: int(seq), Data: []byte("noc2go")}}
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return hopProbe{RTT: -1}
+	}
+
+	t.sendMu.Lock()
+	if t.v6 {
+		err = t.conn.IPv6PacketConn().SetHopLimit(ttl)
+	} else {
+		err = t.conn.IPv4PacketConn().SetTTL(ttl)
+	}
+	sent := time.Now()
+	if err == nil {
+		_, err = t.conn.WriteTo(b, &net.IPAddr{IP: t.dst})
+	}
+	t.sendMu.Unlock()
+	if err != nil {
+		return hopProbe{RTT: -1}
+	}
+	return t.await(ctx, ch, sent, timeout)
+}
+
+// rawUDPProbe sends a datagram with a limited TTL; the answer is an ICMP
+// Time Exceeded from a router or Port Unreachable from the target
+func (t *tracer) rawUDPProbe(ctx context.Context, ttl int, timeout time.Duration) hopProbe {
+	network := "udp4"
+	if t.v6 {
+		network = "udp6"
+	}
+	dport := t.port + ttl - 1
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, net.JoinHostPort(t.dst.String(), strconv.Itoa(dport)))
+	if err != nil {
+		return hopProbe{RTT: -1}
+	}
+	defer conn.Close()
+	if t.v6 {
+		err = ipv6.NewConn(conn).SetHopLimit(ttl)
+	} else {
+		err = ipv4.NewConn(conn).SetTTL(ttl)
+	}
+	if err != nil {
+		return hopProbe{RTT: -1}
+	}
+
+	key := fmt.Sprintf("%d/%d", protocolUDP, conn.LocalAddr().(*net.UDPAddr).Port)
+	ch := t.register(key)
+	defer t.unregister(key)
+
+	sent := time.Now()
+	if _, err := conn.Write([]byte("noc2go")); err != nil {
+		return hopProbe{RTT: -1}
+	}
+	return t.await(ctx, ch, sent, timeout)
+}
+
+// rawTCPProbe starts a TCP handshake with a limited TTL. A router answers
+// with Time Exceeded, the target with SYN-ACK or RST.
+func (t *tracer) rawTCPProbe(ctx context.Context, ttl int, timeout time.Duration) hopProbe {
+	network := "tcp4"
+	if t.v6 {
+		network = "tcp6"
+	}
+	addr := net.JoinHostPort(t.dst.String(), strconv.Itoa(t.port))
+
+	// the local port identifies the probe in quoted ICMP errors, so pick it
+	// ourselves and register before the SYN leaves
+	lport := traceLocalPortBase + rand.IntN(traceLocalPortSpread)
+	key := fmt.Sprintf("%d/%d", protocolTCP, lport)
+	ch := t.register(key)
+	defer t.unregister(key)
+
+	dctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	d := net.Dialer{
+		LocalAddr: &net.TCPAddr{Port: lport},
+		Control: func(_, _ string, c syscall.RawConn) error {
+			var serr error
+			if err := c.Control(func(fd uintptr) { serr = setSocketTTL(fd, t.v6, ttl) }); err != nil {
+				return err
+			}
+			return serr
+		},
+	}
+	type dialResult struct {
+		err error
+		at  time.Time
+	}
+	res := make(chan dialResult, 1)
+	sent := time.Now()
+	go func() {
+		conn, err := d.DialContext(dctx, network, addr)
+		if err == nil {
+			conn.Close()
+		}
+		res <- dialResult{err, time.Now()}
+	}()
+
+	select {
+	case ev := <-ch:
+		cancel()
+		return hopProbe{
+			Addr:    ev.from,
+			RTT:     float64(ev.at.Sub(sent)) / float64(time.Millisecond),
+			Reached: ev.from == t.dst.String(),
+		}
+	case r := <-res:
+		if r.err == nil || errors.Is(r.err, syscall.ECONNREFUSED) {
+			return hopProbe{
+				Addr:    t.dst.String(),
+				RTT:     float64(r.at.Sub(sent)) / float64(time.Millisecond),
+				Reached: true,
+			}
+		}
+		// the dial may fail on the ICMP error before the reader delivered it
+		select {
+		case ev := <-ch:
+			return hopProbe{
+				Addr:    ev.from,
+				RTT:     float64(ev.at.Sub(sent)) / float64(time.Millisecond),
+				Reached: ev.from == t.dst.String(),
+			}
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	return hopProbe{RTT: -1}
+}
+
+// readLoop dispatches raw ICMP messages to the probe they answer
+func (t *tracer) readLoop() {
+	buf := make([]byte, 1500)
+	proto := protocolICMP
+	if t.v6 {
+		proto = protocolICMPv6
+	}
+	for {
+		n, src, err := t.conn.ReadFrom(buf)
+		at := time.Now()
+		if err != nil {
+			select {
+			case <-t.done:
+				return
+			default:
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return
+		}
+		msg, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil {
+			continue
+		}
+
+		var key string
+		switch body := msg.Body.(type) {
+		case *icmp.Echo:
+			if msg.Type != ipv4.ICMPTypeEchoReply && msg.Type != ipv6.ICMPTypeEchoReply || body.ID != t.id {
+				continue
+			}
+			key = fmt.Sprintf("%d/%d", protocolICMP, uint16(body.Seq))
+		case *icmp.TimeExceeded:
+			key = t.quotedKey(body.Data)
+		case *icmp.DstUnreach:
+			key = t.quotedKey(body.Data)
+		}
+		if key == "" {
+			continue
+		}
+
+		t.mu.Lock()
+		ch, ok := t.waiters[key]
+		t.mu.Unlock()
+		if ok {
+			select {
+			case ch <- traceEvent{from: addrIP(src), at: at}:
+			default:
+			}
+		}
+	}
+}
+
+// quotedKey identifies the probe quoted in an ICMP error: echo sequence for
+// ICMP, source port for UDP and TCP
+func (t *tracer) quotedKey(data []byte) string {
+	var hl, proto int
+	var dst net.IP
+	if t.v6 {
+		if len(data) < ipv6.HeaderLen {
+			return ""
+		}
+		hl, proto, dst = ipv6.HeaderLen, int(data[6]), net.IP(data[24:40])
+	} else {
+		if len(data) < ipv4.HeaderLen {
+			return ""
+		}
+		hl, proto, dst = int(data[0]&0x0f)<<2, int(data[9]), net.IP(data[16:20])
+	}
+	if len(data) < hl+8 || !dst.Equal(t.dst) {
+		return ""
+	}
+	inner := data[hl:]
+	switch proto {
+	case protocolICMP, protocolICMPv6:
+		if int(binary.BigEndian.Uint16(inner[4:6])) != t.id {
+			return ""
+		}
+		return fmt.Sprintf("%d/%d", protocolICMP, binary.BigEndian.Uint16(inner[6:8]))
+	case protocolUDP, protocolTCP:
+		return fmt.Sprintf("%d/%d", proto, binary.BigEndian.Uint16(inner[0:2]))
+	}
+	return ""
+}
+
+// tracePageHandler renders GET /traceroute
+func tracePageHandler(cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		data := struct {
+			Privileged bool
+			Targets    []string
+		}{isPrivileged, cfg.Ping.Targets}
+		templates.ExecuteTemplate(w, "traceroute.html", data)
+	}
+}
+
+// traceHop is the payload of a "hop" SSE event
+type traceHop struct {
+	Hop     int       `json:"hop"`
+	Address string    `json:"address"`
+	Name    string    `json:"name"`
+	RTTs    []float64 `json:"rtts"` // ms, -1 = no answer
+	Reached bool      `json:"reached"`
+}
+
+// parseTraceParams reads target, method, port and max_hops shared by
+// traceroute and MTR and builds the tracer; it writes the HTTP error itself
+func parseTraceParams(w http.ResponseWriter, r *http.Request) (*tracer, int, bool) {
+	q := r.URL.Query()
+	method := q.Get("method")
+	if method == "" {
+		method = "icmp"
+	}
+	port := 0
+	switch method {
+	case "icmp":
+	case "udp":
+		port = intParam(q.Get("port"), defaultTraceUDPPort)
+	case "tcp":
+		port = intParam(q.Get("port"), defaultTraceTCPPort)
+	default:
+		http.Error(w, "method must be icmp, udp or tcp", http.StatusBadRequest)
+		return nil, 0, false
+	}
+	maxHops := intParam(q.Get("max_hops"), defaultTraceMaxHops)
+	if maxHops < 1 || maxHops > maxTraceHops {
+		http.Error(w, fmt.Sprintf("max_hops must be between 1 and %d", maxTraceHops), http.StatusBadRequest)
+		return nil, 0, false
+	}
+	// UDP probes go to port+ttl-1, the last hop must stay a valid port
+	maxPort := 65535
+	if method == "udp" {
+		maxPort = 65535 - maxHops + 1
+	}
+	if method != "icmp" && (port < 1 || port > maxPort) {
+		http.Error(w, fmt.Sprintf("port must be between 1 and %d", maxPort), http.StatusBadRequest)
+		return nil, 0, false
+	}
+
+	ip, err := resolveTarget(q.Get("target"), q.Get("family"))
+	if err != nil {
+		http.Error(w, "cannot resolve target", http.StatusBadRequest)
+		return nil, 0, false
+	}
+	t, err := newTracer(ip, method, port, isPrivileged)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, 0, false
+	}
+	return t, maxHops, true
+}
+
+// apiTraceHandler streams GET /api/traceroute hop by hop via SSE
+func apiTraceHandler(cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		release, ok := acquireProbeSlot(w, r, cfg)
+		if !ok {
+			return
+		}
+		defer release()
+
+		t, maxHops, ok := parseTraceParams(w, r)
+		if !ok {
+			return
+		}
+		defer t.Close()
+
+		flusher, ok := startSSE(w)
+		if !ok {
+			return
+		}
+
+		ctx := r.Context()
+		reached := false
+		hops := 0
+		for ttl := 1; ttl <= maxHops && !reached; ttl++ {
+			hop := traceHop{Hop: ttl, RTTs: make([]float64, 0, traceProbesPerHop)}
+			for i := 0; i < traceProbesPerHop; i++ {
+				p := t.probe(ctx, ttl, traceTimeout)
+				if ctx.Err() != nil {
+					return
+				}
+				hop.RTTs = append(hop.RTTs, p.RTT)
+				if hop.Address == "" && p.Addr != "" {
+					hop.Address = p.Addr
+				}
+				reached = reached || p.Reached
+			}
+			hop.Reached = reached
+			if hop.Address != "" {
+				hop.Name = reverseName(ctx, hop.Address)
+			}
+			hops = ttl
+			data, _ := json.Marshal(hop)
+			fmt.Fprintf(w, "event: hop\ndata: %s\n\n", data)
+			flusher.Flush()
+		}
+
+		data, _ := json.Marshal(map[string]interface{}{
+			"target":  t.dst.String(),
+			"hops":    hops,
+			"reached": reached,
+		})
+		fmt.Fprintf(w, "event: summary\ndata: %s\n\n", data)
+		flusher.Flush()
+	}
+}
+
+// resolveTarget returns target as an IP, preferring the requested family
+func resolveTarget(target, family string) (net.IP, error) {
+	if ip := net.ParseIP(target); ip != nil {
+		return ip, nil
+	}
+	ips, err := net.LookupIP(target)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no addresses for %s", target)
+	}
+	for _, ip := range ips {
+		if family == "ipv6" && ip.To4() == nil ||
+			family != "ipv6" && ip.To4() != nil {
+			return ip, nil
+		}
+	}
+	return ips[0], nil
+}
+
+// reverseName returns the first PTR name for ip via lookupDNS, or ""
+func reverseName(ctx context.Context, ip string) string {
+	records, _, err := lookupDNS(ctx, ip, "PTR", "")
+	if err != nil {
+		return ""
+	}
+	if arr, ok := records.([]map[string]interface{}); ok && len(arr) > 0 {
+		host, _ := arr[0]["host"].(string)
+		return host
+	}
+	return ""
+}
@@ -0,0 +1,161 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	soEEOriginICMP  = 2
+	soEEOriginICMP6 = 3
+	sockExtErrLen   = 16
+)
+
+// recvErrSupported reports whether method works without raw sockets
+func recvErrSupported(method string) error {
+	if method == "tcp" {
+		return errors.New("tcp traceroute needs raw sockets (--privileged)")
+	}
+	return nil
+}
+
+// recvErrProbe sends one UDP or ICMP datagram with a limited TTL on its own
+// unprivileged socket and reads the router's ICMP error from the kernel
+// error queue (IP_RECVERR), like tracepath does.
+func (t *tracer) recvErrProbe(ctx context.Context, ttl int, timeout time.Duration) hopProbe {
+	fail := hopProbe{RTT: -1}
+	family, proto, level, opt := syscall.AF_INET, syscall.IPPROTO_UDP, syscall.IPPROTO_IP, syscall.IP_RECVERR
+	if t.v6 {
+		family, level, opt = syscall.AF_INET6, syscall.IPPROTO_IPV6, syscall.IPV6_RECVERR
+	}
+	if t.method == "icmp" {
+		proto = syscall.IPPROTO_ICMP
+		if t.v6 {
+			proto = syscall.IPPROTO_ICMPV6
+		}
+	}
+
+	s, err := syscall.Socket(family, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return fail
+	}
+	if setSocketTTL(uintptr(s), t.v6, ttl) != nil || syscall.SetsockoptInt(s, level, opt, 1) != nil {
+		syscall.Close(s)
+		return fail
+	}
+	f := os.NewFile(uintptr(s), "traceroute probe")
+	c, err := net.FilePacketConn(f)
+	f.Close()
+	if err != nil {
+		return fail
+	}
+	defer c.Close()
+	stop := context.AfterFunc(ctx, func() { c.SetReadDeadline(time.Now()) })
+	defer stop()
+	c.SetReadDeadline(time.Now().Add(timeout))
+
+	payload := []byte("noc2go")
+	dst := &net.UDPAddr{IP: t.dst, Port: t.port + ttl - 1}
+	if t.method == "icmp" {
+		var typ icmp.Type = ipv4.ICMPTypeEcho
+		if t.v6 {
+			typ = ipv6.ICMPTypeEchoRequest
+		}
+		msg := icmp.Message{Type: typ, Body: &icmp.Echo{ID: t.id, Seq: ttl, Data: payload}}
+		if payload, err = msg.Marshal(nil); err != nil {
+			return fail
+		}
+		dst.Port = 0
+	}
+
+	sent := time.Now()
+	if _, err := c.WriteTo(payload, dst); err != nil {
+		return fail
+	}
+	rc, err := c.(syscall.Conn).SyscallConn()
+	if err != nil {
+		return fail
+	}
+
+	result := fail
+	buf := make([]byte, 1500)
+	oob := make([]byte, 512)
+	rc.Read(func(fd uintptr) bool {
+		// ICMP errors queued by IP_RECVERR
+		for {
+			_, oobn, _, _, err := syscall.Recvmsg(int(fd), buf, oob, syscall.MSG_ERRQUEUE)
+			if err != nil {
+				break
+			}
+			if from := recvErrOffender(oob[:oobn]); from != nil {
+				result = hopProbe{
+					Addr:    from.String(),
+					RTT:     float64(time.Since(sent)) / float64(time.Millisecond),
+					Reached: from.Equal(t.dst),
+				}
+				return true
+			}
+		}
+		// regular answer from the destination (echo reply or UDP response)
+		n, _, _, _, err := syscall.Recvmsg(int(fd), buf, nil, syscall.MSG_DONTWAIT)
+		if err != nil {
+			return false
+		}
+		if t.method == "icmp" {
+			p := protocolICMP
+			if t.v6 {
+				p = protocolICMPv6
+			}
+			m, err := icmp.ParseMessage(p, buf[:n])
+			if err != nil || (m.Type != ipv4.ICMPTypeEchoReply && m.Type != ipv6.ICMPTypeEchoReply) {
+				return false
+			}
+		}
+		result = hopProbe{
+			Addr:    t.dst.String(),
+			RTT:     float64(time.Since(sent)) / float64(time.Millisecond),
+			Reached: true,
+		}
+		return true
+	})
+	return result
+}
+
+// recvErrOffender extracts the ICMP sender from an IP_RECVERR control message
+func recvErrOffender(oob []byte) net.IP {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil
+	}
+	for _, m := range msgs {
+		isV4 := m.Header.Level == syscall.IPPROTO_IP && m.Header.Type == syscall.IP_RECVERR
+		isV6 := m.Header.Level == syscall.IPPROTO_IPV6 && m.Header.Type == syscall.IPV6_RECVERR
+		if !isV4 && !isV6 || len(m.Data) < sockExtErrLen {
+			continue
+		}
+		// struct sock_extended_err, followed by the offender's sockaddr
+		origin := m.Data[4]
+		if origin != soEEOriginICMP && origin != soEEOriginICMP6 {
+			continue
+		}
+		sa := m.Data[sockExtErrLen:]
+		switch {
+		case isV4 && len(sa) >= 8:
+			return net.IP(append([]byte(nil), sa[4:8]...))
+		case isV6 && len(sa) >= 24:
+			return net.IP(append([]byte(nil), sa[8:24]...))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// recvErrSupported reports whether method works without raw sockets
+func recvErrSupported(method string) error {
+	return errors.New("traceroute needs raw sockets (--privileged) on this platform")
+}
+
+// recvErrProbe is only implemented on Linux
+func (t *tracer) recvErrProbe(ctx context.Context, ttl int, timeout time.Duration) hopProbe {
+	return hopProbe{RTT: -1}
+}